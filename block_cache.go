@@ -0,0 +1,284 @@
+package proton_api_bridge
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The block cache keeps the encrypted blocks, as they are returned by GetBlock, on disk.
+
+The blocks stay encrypted with the node session key, so the cache directory needs no extra protection.
+The entries are keyed by the block hash, which is the sha256 of the encrypted block, and the hash is
+verified again on every hit, so a corrupted or tampered entry is dropped and the block is downloaded again.
+
+The total size is bounded by BlockCacheMaxSize, evicting the least recently used blocks first.
+The file modification time serves as the access time, so the LRU order survives a restart.
+*/
+
+const BLOCK_CACHE_TEMP_FILE_SUFFIX = ".tmp"
+
+type blockCacheEntry struct {
+	key  string
+	size int64
+}
+
+type blockCache struct {
+	dir     string
+	maxSize int64
+
+	sync.Mutex
+	size    int64
+	lru     *list.List // front is the most recently used
+	entries map[string]*list.Element
+}
+
+func newBlockCache(dir string, maxSize int64) (*blockCache, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	cache := &blockCache{
+		dir:     dir,
+		maxSize: maxSize,
+
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type existingEntry struct {
+		blockCacheEntry
+		modTime time.Time
+	}
+	existingEntries := make([]existingEntry, 0, len(dirEntries))
+	for i := range dirEntries {
+		name := dirEntries[i].Name()
+		if isBlockCacheTempFile(name) {
+			// leftover of an interrupted download
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if !dirEntries[i].Type().IsRegular() || !isBlockCacheKey(name) {
+			continue
+		}
+
+		info, err := dirEntries[i].Info()
+		if err != nil {
+			continue
+		}
+		existingEntries = append(existingEntries, existingEntry{blockCacheEntry{key: name, size: info.Size()}, info.ModTime()})
+	}
+
+	sort.Slice(existingEntries, func(i, j int) bool {
+		return existingEntries[i].modTime.Before(existingEntries[j].modTime)
+	})
+	for i := range existingEntries {
+		cache.entries[existingEntries[i].key] = cache.lru.PushFront(&existingEntries[i].blockCacheEntry)
+		cache.size += existingEntries[i].size
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+	cache._evict()
+
+	return cache, nil
+}
+
+// blockCacheKey turns the base64 block hash into a file name, "" if the hash is malformed
+func blockCacheKey(blockHash string) string {
+	hash, err := base64.StdEncoding.DecodeString(blockHash)
+	if err != nil || len(hash) != sha256.Size {
+		return ""
+	}
+
+	return hex.EncodeToString(hash)
+}
+
+func isBlockCacheKey(name string) bool {
+	hash, err := hex.DecodeString(name)
+	return err == nil && len(hash) == sha256.Size && name == hex.EncodeToString(hash)
+}
+
+// isBlockCacheTempFile only matches the names from newWriter, the directory might be shared with other programs
+func isBlockCacheTempFile(name string) bool {
+	name, ok := strings.CutSuffix(name, BLOCK_CACHE_TEMP_FILE_SUFFIX)
+	if !ok {
+		return false
+	}
+
+	// the random part added by os.CreateTemp
+	key, _, ok := strings.Cut(name, ".")
+	return ok && isBlockCacheKey(key)
+}
+
+func (cache *blockCache) path(key string) string {
+	return filepath.Join(cache.dir, key)
+}
+
+// get returns the encrypted block, or false if it isn't cached or the cached content doesn't match the hash
+func (cache *blockCache) get(blockHash string) ([]byte, bool) {
+	if cache == nil {
+		return nil, false
+	}
+
+	key := blockCacheKey(blockHash)
+	if key == "" {
+		return nil, false
+	}
+
+	cache.Lock()
+	elem, ok := cache.entries[key]
+	if ok {
+		cache.lru.MoveToFront(elem)
+	}
+	cache.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	data, err := os.ReadFile(cache.path(key))
+	if err != nil {
+		cache.remove(key)
+		return nil, false
+	}
+
+	hash := sha256.Sum256(data)
+	if hex.EncodeToString(hash[:]) != key {
+		log.Println("Block cache entry failed hash verification, dropping", key)
+		cache.remove(key)
+		return nil, false
+	}
+
+	// best effort, only used to restore the LRU order on the next start
+	now := time.Now()
+	_ = os.Chtimes(cache.path(key), now, now)
+
+	return data, true
+}
+
+func (cache *blockCache) remove(key string) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	cache._remove(key)
+}
+
+func (cache *blockCache) _remove(key string) {
+	elem, ok := cache.entries[key]
+	if !ok {
+		return
+	}
+
+	cache.lru.Remove(elem)
+	delete(cache.entries, key)
+	cache.size -= elem.Value.(*blockCacheEntry).size
+	os.Remove(cache.path(key))
+}
+
+func (cache *blockCache) _evict() {
+	for cache.size > cache.maxSize && cache.lru.Len() > 0 {
+		cache._remove(cache.lru.Back().Value.(*blockCacheEntry).key)
+	}
+}
+
+// newWriter returns a writer to tee the encrypted block into while it's being downloaded, nil if the block can't be cached.
+// Nothing is visible in the cache until commit, which must only be called once the block passed the hash verification.
+func (cache *blockCache) newWriter(blockHash string) *blockCacheWriter {
+	if cache == nil {
+		return nil
+	}
+
+	key := blockCacheKey(blockHash)
+	if key == "" {
+		return nil
+	}
+
+	file, err := os.CreateTemp(cache.dir, key+".*"+BLOCK_CACHE_TEMP_FILE_SUFFIX)
+	if err != nil {
+		log.Println("Block cache disabled for block", key, err)
+		return nil
+	}
+
+	return &blockCacheWriter{
+		cache: cache,
+		key:   key,
+		file:  file,
+	}
+}
+
+type blockCacheWriter struct {
+	cache *blockCache
+	key   string
+	file  *os.File
+	size  int64
+	err   error
+	done  bool
+}
+
+// Write never fails, a cache write error must not fail the download, the block is just not cached
+func (w *blockCacheWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		var n int
+		n, w.err = w.file.Write(p)
+		w.size += int64(n)
+	}
+
+	return len(p), nil
+}
+
+func (w *blockCacheWriter) commit() {
+	if w.done {
+		return
+	}
+	w.done = true
+
+	tempPath := w.file.Name()
+	err := w.file.Close()
+	if w.err != nil || err != nil {
+		os.Remove(tempPath)
+		return
+	}
+
+	cache := w.cache
+	cache.Lock()
+	defer cache.Unlock()
+
+	// replace an entry of the same block, the content is identical
+	cache._remove(w.key)
+	err = os.Rename(tempPath, cache.path(w.key))
+	if err != nil {
+		os.Remove(tempPath)
+		return
+	}
+
+	cache.entries[w.key] = cache.lru.PushFront(&blockCacheEntry{key: w.key, size: w.size})
+	cache.size += w.size
+	cache._evict()
+}
+
+// abort discards the written content, it's a no-op after commit
+func (w *blockCacheWriter) abort() {
+	if w.done {
+		return
+	}
+	w.done = true
+
+	tempPath := w.file.Name()
+	w.file.Close()
+	os.Remove(tempPath)
+}
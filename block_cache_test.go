@@ -0,0 +1,154 @@
+package proton_api_bridge
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testBlockHash(data []byte) string {
+	hash := sha256.Sum256(data)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// put caches the block as if it had been downloaded and verified
+func (cache *blockCache) put(blockHash string, data []byte) {
+	writer := cache.newWriter(blockHash)
+	if writer == nil {
+		return
+	}
+	defer writer.abort()
+
+	_, _ = writer.Write(data)
+	writer.commit()
+}
+
+func TestBlockCacheGetVerifiesHash(t *testing.T) {
+	cache, err := newBlockCache(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := []byte("encrypted block")
+	blockHash := testBlockHash(block)
+	if _, ok := cache.get(blockHash); ok {
+		t.Fatalf("empty cache should miss")
+	}
+
+	cache.put(blockHash, block)
+	data, ok := cache.get(blockHash)
+	if !ok || string(data) != string(block) {
+		t.Fatalf("expected a hit with %q, got %q", block, data)
+	}
+
+	// corrupt the entry on disk
+	err = os.WriteFile(cache.path(blockCacheKey(blockHash)), []byte("tampered block"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.get(blockHash); ok {
+		t.Fatalf("an entry failing the hash verification should miss")
+	}
+	if _, err := os.Stat(cache.path(blockCacheKey(blockHash))); !os.IsNotExist(err) {
+		t.Fatalf("an entry failing the hash verification should be removed, got %v", err)
+	}
+	if cache.size != 0 {
+		t.Fatalf("expected size 0, got %v", cache.size)
+	}
+}
+
+func TestBlockCacheAbortedWriterIsNotCached(t *testing.T) {
+	cache, err := newBlockCache(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := []byte("encrypted block")
+	writer := cache.newWriter(testBlockHash(block))
+	if _, err := writer.Write(block); err != nil {
+		t.Fatal(err)
+	}
+	writer.abort()
+	writer.commit()
+
+	if _, ok := cache.get(testBlockHash(block)); ok {
+		t.Fatalf("an aborted block should not be cached")
+	}
+	entries, err := os.ReadDir(cache.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected an empty cache directory, got %v entries", len(entries))
+	}
+}
+
+func TestBlockCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := newBlockCache(dir, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := [][]byte{[]byte("0123456789"), []byte("abcdefghij"), []byte("ABCDEFGHIJ")}
+	cache.put(testBlockHash(blocks[0]), blocks[0])
+	cache.put(testBlockHash(blocks[1]), blocks[1])
+	if _, ok := cache.get(testBlockHash(blocks[0])); !ok {
+		t.Fatalf("block 0 should be cached")
+	}
+
+	// block 1 is now the least recently used one
+	cache.put(testBlockHash(blocks[2]), blocks[2])
+	if _, ok := cache.get(testBlockHash(blocks[1])); ok {
+		t.Fatalf("block 1 should have been evicted")
+	}
+	for _, i := range []int{0, 2} {
+		if _, ok := cache.get(testBlockHash(blocks[i])); !ok {
+			t.Fatalf("block %v should be cached", i)
+		}
+	}
+
+	// the entries are picked up again after a restart
+	cache, err = newBlockCache(dir, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.size != 20 || cache.lru.Len() != 2 {
+		t.Fatalf("expected 2 entries of 20 bytes in total, got %v entries of %v bytes", cache.lru.Len(), cache.size)
+	}
+	if _, ok := cache.get(testBlockHash(blocks[2])); !ok {
+		t.Fatalf("block 2 should be cached after the restart")
+	}
+}
+
+func TestBlockCacheOnlyRemovesItsOwnTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	key := blockCacheKey(testBlockHash([]byte("encrypted block")))
+
+	leftover := filepath.Join(dir, key+".123456"+BLOCK_CACHE_TEMP_FILE_SUFFIX)
+	others := []string{
+		filepath.Join(dir, "download"+BLOCK_CACHE_TEMP_FILE_SUFFIX),
+		filepath.Join(dir, "other.123456"+BLOCK_CACHE_TEMP_FILE_SUFFIX),
+		filepath.Join(dir, key+BLOCK_CACHE_TEMP_FILE_SUFFIX),
+	}
+	for _, path := range append(others, leftover) {
+		if err := os.WriteFile(path, []byte("content"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := newBlockCache(dir, 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Fatalf("expected the leftover of an interrupted download to be removed, got %v", err)
+	}
+	for _, path := range others {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("expected %v to be left alone, got %v", filepath.Base(path), err)
+		}
+	}
+}
@@ -2,11 +2,15 @@ package proton_api_bridge
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 
 	"github.com/ProtonMail/gopenpgp/v2/crypto"
 	"github.com/ProtonMail/go-proton-api"
+	"golang.org/x/sync/singleflight"
 )
 
 type cacheEntry struct {
@@ -19,6 +23,13 @@ type cache struct {
 	children      map[string]map[string]interface{}
 	enableCaching bool
 
+	// number of times the bookkeeping was found to be inconsistent and had to be healed
+	inconsistencyCount atomic.Uint64
+
+	// coalesce concurrent link fetches and keyring unlocks, keyed by linkID
+	linkFetchGroup  singleflight.Group
+	linkUnlockGroup singleflight.Group
+
 	sync.RWMutex
 }
 
@@ -60,7 +71,21 @@ func (cache *cache) _get(linkID string) *cacheEntry {
 	return nil
 }
 
-func (cache *cache) _insert(linkID string, link *proton.Link, kr *crypto.KeyRing) {
+func (cache *cache) _getKR(linkID string) *crypto.KeyRing {
+	if !cache.enableCaching {
+		return nil
+	}
+
+	cache.RLock()
+	defer cache.RUnlock()
+
+	if data, ok := cache.data[linkID]; ok {
+		return data.kr
+	}
+	return nil
+}
+
+func (cache *cache) _setKR(linkID string, kr *crypto.KeyRing) {
 	if !cache.enableCaching {
 		return
 	}
@@ -68,73 +93,146 @@ func (cache *cache) _insert(linkID string, link *proton.Link, kr *crypto.KeyRing
 	cache.Lock()
 	defer cache.Unlock()
 
+	if data, ok := cache.data[linkID]; ok {
+		data.kr = kr
+	}
+}
+
+func (cache *cache) _insert(linkID string, link *proton.Link, kr *crypto.KeyRing) error {
+	if !cache.enableCaching {
+		return nil
+	}
+
+	if link == nil {
+		// we should never have missing link, refuse to cache it instead of corrupting the children map
+		cache.inconsistencyCount.Add(1)
+		return ErrCacheInsertMissingLink
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	// the link might have been moved since we last cached it, so we detach it from its previous parent first
+	if data, ok := cache.data[linkID]; ok && data.link != nil && data.link.ParentLinkID != link.ParentLinkID {
+		if siblings, ok := cache.children[data.link.ParentLinkID]; ok {
+			delete(siblings, linkID)
+		}
+	}
+
 	cache.data[linkID] = &cacheEntry{
 		link: link,
 		kr:   kr,
 	}
 
-	if link != nil {
-		if data, ok := cache.children[link.ParentLinkID]; ok {
-			data[link.LinkID] = nil
-			cache.children[link.ParentLinkID] = data
-		} else {
-			tmp := make(map[string]interface{})
-			tmp[link.LinkID] = nil
-			cache.children[link.ParentLinkID] = tmp
-
-		}
+	if data, ok := cache.children[link.ParentLinkID]; ok {
+		data[link.LinkID] = nil
+		cache.children[link.ParentLinkID] = data
 	} else {
-		// TODO: we should never have missing link though
-		log.Fatalln("we should never have missing link though")
+		tmp := make(map[string]interface{})
+		tmp[link.LinkID] = nil
+		cache.children[link.ParentLinkID] = tmp
 	}
+
+	return nil
 }
 
 // due to recursion, we can't perform locking here
 // this function should only be called from _remove
-func (cache *cache) _remove_nolock(linkID string, includingChildren bool) {
+//
+// When the bookkeeping turns out to be inconsistent, the whole subtree of linkID is dropped
+// so it will be refetched on the next access, and ErrCacheInconsistency is returned
+func (cache *cache) _remove_nolock(linkID string, includingChildren bool) error {
 	var link *proton.Link
 	if data, ok := cache.data[linkID]; ok {
 		link = data.link
 		delete(cache.data, linkID)
 	} else {
-		return
+		return nil
 	}
 
-	// remove linkID from parent's map
-	if data, ok := cache.children[link.ParentLinkID]; ok {
-		if _, ok := data[link.LinkID]; ok {
-			delete(data, link.LinkID)
-			cache.children[link.ParentLinkID] = data
-		} else {
-			log.Fatalln("we have an issue for cache inconsistency where link is not found in the parent's map")
-		}
+	var ret error
+	if link == nil {
+		ret = fmt.Errorf("%w: link %v has no link data", ErrCacheInconsistency, linkID)
+	} else if data, ok := cache.children[link.ParentLinkID]; !ok {
+		ret = fmt.Errorf("%w: the parent map of link %v is missing", ErrCacheInconsistency, linkID)
+	} else if _, ok := data[link.LinkID]; !ok {
+		ret = fmt.Errorf("%w: link %v is not found in the parent's map", ErrCacheInconsistency, linkID)
 	} else {
-		log.Fatalln("we have an issue for cache inconsistency where link's parent map is missing")
+		// remove linkID from parent's map
+		delete(data, link.LinkID)
+		cache.children[link.ParentLinkID] = data
+	}
+
+	if ret != nil {
+		// we can't trust anything cached below this link anymore
+		cache.inconsistencyCount.Add(1)
+		includingChildren = true
 	}
 
 	// we don't recursively go upward to clean up the parent's map
 	// instead, we rely on periodic cache flushing
 	if includingChildren {
-		if data, ok := cache.children[link.LinkID]; ok {
+		if data, ok := cache.children[linkID]; ok {
 			for k := range data {
-				cache._remove_nolock(k, true)
+				if err := cache._remove_nolock(k, true); err != nil {
+					ret = errors.Join(ret, err)
+				}
 			}
 		} // else {
 		// might have nothing is the link doesn't have any children
 		// }
-		delete(cache.children, link.LinkID)
+		delete(cache.children, linkID)
 	}
+
+	return ret
 }
 
-func (cache *cache) _remove(linkID string, includingChildren bool) {
+func (cache *cache) _remove(linkID string, includingChildren bool) error {
 	if !cache.enableCaching {
-		return
+		return nil
 	}
 
 	cache.Lock()
 	defer cache.Unlock()
 
-	cache._remove_nolock(linkID, includingChildren)
+	return cache._remove_nolock(linkID, includingChildren)
+}
+
+// _verify checks that the data and children maps agree with each other
+func (cache *cache) _verify() error {
+	if !cache.enableCaching {
+		return nil
+	}
+
+	cache.RLock()
+	defer cache.RUnlock()
+
+	var ret error
+	for linkID, entry := range cache.data {
+		if entry == nil || entry.link == nil {
+			ret = errors.Join(ret, fmt.Errorf("%w: link %v has no link data", ErrCacheInconsistency, linkID))
+			continue
+		}
+		if entry.link.LinkID != linkID {
+			ret = errors.Join(ret, fmt.Errorf("%w: link %v is cached under %v", ErrCacheInconsistency, entry.link.LinkID, linkID))
+		}
+		if _, ok := cache.children[entry.link.ParentLinkID][linkID]; !ok {
+			ret = errors.Join(ret, fmt.Errorf("%w: link %v is not found in the parent's map", ErrCacheInconsistency, linkID))
+		}
+	}
+
+	for parentLinkID, children := range cache.children {
+		for linkID := range children {
+			entry, ok := cache.data[linkID]
+			if !ok {
+				ret = errors.Join(ret, fmt.Errorf("%w: child %v of %v is not cached", ErrCacheInconsistency, linkID, parentLinkID))
+			} else if entry != nil && entry.link != nil && entry.link.ParentLinkID != parentLinkID {
+				ret = errors.Join(ret, fmt.Errorf("%w: child %v is listed under %v but its parent is %v", ErrCacheInconsistency, linkID, parentLinkID, entry.link.ParentLinkID))
+			}
+		}
+	}
+
+	return ret
 }
 
 /* The original non-caching version, which resolves the keyring recursively */
@@ -204,15 +302,25 @@ func (protonDrive *ProtonDrive) getLink(ctx context.Context, linkID string) (*pr
 	}
 
 	// no cached data, fetch
-	link, err := protonDrive.c.GetLink(ctx, protonDrive.MainShare.ShareID, linkID)
+	// concurrent walkers asking for the same linkID share a single API call
+	ret, err := doShared(ctx, &protonDrive.cache.linkFetchGroup, linkID, func(ctx context.Context) (interface{}, error) {
+		link, err := protonDrive.api.GetLink(ctx, protonDrive.MainShare.ShareID, linkID)
+		if err != nil {
+			return nil, err
+		}
+
+		// populate cache
+		if err := protonDrive.cache._insert(linkID, &link, nil); err != nil {
+			return nil, err
+		}
+
+		return &link, nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	// populate cache
-	protonDrive.cache._insert(linkID, &link, nil)
-
-	return &link, nil
+	return ret.(*proton.Link), nil
 }
 
 func (protonDrive *ProtonDrive) getLinkKR(ctx context.Context, link *proton.Link) (*crypto.KeyRing, error) {
@@ -226,30 +334,44 @@ func (protonDrive *ProtonDrive) getLinkKR(ctx context.Context, link *proton.Link
 
 	// attempt to get from cache first
 	if data := protonDrive.cache._get(link.LinkID); data != nil && data.link != nil {
-		if data.kr != nil {
-			return data.kr, nil
+		if kr := protonDrive.cache._getKR(link.LinkID); kr != nil {
+			return kr, nil
 		}
 
 		// decrypt keyring and cache it
-		parentNodeKR, err := protonDrive.getLinkKRByID(ctx, data.link.ParentLinkID)
-		if err != nil {
-			return nil, err
-		}
+		// concurrent walkers asking for the same linkID share a single decryption
+		ret, err := doShared(ctx, &protonDrive.cache.linkUnlockGroup, link.LinkID, func(ctx context.Context) (interface{}, error) {
+			if kr := protonDrive.cache._getKR(link.LinkID); kr != nil {
+				return kr, nil
+			}
 
-		signatureVerificationKR, err := protonDrive.getSignatureVerificationKeyring([]string{data.link.SignatureEmail})
-		if err != nil {
-			return nil, err
-		}
-		kr, err := data.link.GetKeyRing(parentNodeKR, signatureVerificationKR)
+			parentNodeKR, err := protonDrive.getLinkKRByID(ctx, data.link.ParentLinkID)
+			if err != nil {
+				return nil, err
+			}
+
+			signatureVerificationKR, err := protonDrive.getSignatureVerificationKeyring([]string{data.link.SignatureEmail})
+			if err != nil {
+				return nil, err
+			}
+			kr, err := data.link.GetKeyRing(parentNodeKR, signatureVerificationKR)
+			if err != nil {
+				return nil, err
+			}
+			protonDrive.cache._setKR(link.LinkID, kr)
+			return kr, nil
+		})
 		if err != nil {
 			return nil, err
 		}
-		data.kr = kr
-		return data.kr, nil
+
+		return ret.(*crypto.KeyRing), nil
 	}
 
 	// no cached data, fetch
-	protonDrive.cache._insert(link.LinkID, link, nil)
+	if err := protonDrive.cache._insert(link.LinkID, link, nil); err != nil {
+		return nil, err
+	}
 
 	return protonDrive.getLinkKR(ctx, link)
 }
@@ -286,11 +408,24 @@ func (protonDrive *ProtonDrive) removeLinkIDFromCache(linkID string, includingCh
 	// log.Println("===================================")
 	// log.Println(linkID, includingChildren)
 	// protonDrive.cache._debug()
-	protonDrive.cache._remove(linkID, includingChildren)
+	if err := protonDrive.cache._remove(linkID, includingChildren); err != nil {
+		// the inconsistent subtree has been dropped, and will be refetched on the next access
+		log.Println("Cache healed from inconsistency:", err)
+	}
 	// protonDrive.cache._debug()
 	// log.Println("===================================")
 }
 
+// VerifyCache reports an error if the cached links and the parent-children bookkeeping disagree
+func (protonDrive *ProtonDrive) VerifyCache() error {
+	return protonDrive.cache._verify()
+}
+
+// CacheInconsistencyCount returns the number of times the cache had to heal itself from inconsistent bookkeeping
+func (protonDrive *ProtonDrive) CacheInconsistencyCount() uint64 {
+	return protonDrive.cache.inconsistencyCount.Load()
+}
+
 func (protonDrive *ProtonDrive) ClearCache() {
 	if !protonDrive.cache.enableCaching {
 		return
@@ -307,3 +442,19 @@ func (protonDrive *ProtonDrive) ClearCache() {
 	protonDrive.cache.data = make(map[string]*cacheEntry)
 	protonDrive.cache.children = make(map[string]map[string]interface{})
 }
+
+// doShared runs fn once for the concurrent callers with the same key.
+// fn isn't cancelled with the caller who happens to start it, as the others are still waiting for it,
+// but each caller stops waiting once its own ctx is done.
+func doShared(ctx context.Context, group *singleflight.Group, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	resultChan := group.DoChan(key, func() (interface{}, error) {
+		return fn(context.WithoutCancel(ctx))
+	})
+
+	select {
+	case result := <-resultChan:
+		return result.Val, result.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -1 +1,204 @@
 package proton_api_bridge
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-proton-api"
+)
+
+// fakeDriveAPI serves the routes which are set, and panics on the others
+type fakeDriveAPI struct {
+	driveAPI
+
+	getLink            func(ctx context.Context, shareID, linkID string) (proton.Link, error)
+	getBlock           func(ctx context.Context, bareURL, token string) (io.ReadCloser, error)
+	requestBlockUpload func(ctx context.Context, req proton.BlockUploadReq) ([]proton.BlockUploadLink, error)
+	uploadBlock        func(ctx context.Context, bareURL, token string, block io.Reader) error
+	commitRevision     func(ctx context.Context, shareID, linkID, revisionID string, req proton.CommitRevisionReq) error
+}
+
+func (api *fakeDriveAPI) GetLink(ctx context.Context, shareID, linkID string) (proton.Link, error) {
+	return api.getLink(ctx, shareID, linkID)
+}
+
+func (api *fakeDriveAPI) GetBlock(ctx context.Context, bareURL, token string) (io.ReadCloser, error) {
+	return api.getBlock(ctx, bareURL, token)
+}
+
+func (api *fakeDriveAPI) RequestBlockUpload(ctx context.Context, req proton.BlockUploadReq) ([]proton.BlockUploadLink, error) {
+	return api.requestBlockUpload(ctx, req)
+}
+
+func (api *fakeDriveAPI) UploadBlock(ctx context.Context, bareURL, token string, block io.Reader) error {
+	return api.uploadBlock(ctx, bareURL, token, block)
+}
+
+func (api *fakeDriveAPI) CommitRevision(ctx context.Context, shareID, linkID, revisionID string, req proton.CommitRevisionReq) error {
+	return api.commitRevision(ctx, shareID, linkID, revisionID, req)
+}
+
+func newTestLink(linkID, parentLinkID string) *proton.Link {
+	return &proton.Link{
+		LinkID:       linkID,
+		ParentLinkID: parentLinkID,
+	}
+}
+
+func TestCacheVerifyAfterInsertAndRemove(t *testing.T) {
+	protonDrive := &ProtonDrive{cache: newCache(true)}
+
+	for _, link := range []*proton.Link{
+		newTestLink("root", ""),
+		newTestLink("a", "root"),
+		newTestLink("b", "a"),
+		newTestLink("c", "a"),
+	} {
+		if err := protonDrive.cache._insert(link.LinkID, link, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := protonDrive.VerifyCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	// "b" moved from "a" to "root"
+	if err := protonDrive.cache._insert("b", newTestLink("b", "root"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := protonDrive.VerifyCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	protonDrive.removeLinkIDFromCache("a", true)
+	if err := protonDrive.VerifyCache(); err != nil {
+		t.Fatal(err)
+	}
+	if protonDrive.cache._get("c") != nil {
+		t.Fatalf("child c should have been removed together with a")
+	}
+	if protonDrive.cache._get("b") == nil {
+		t.Fatalf("b should still be cached under root")
+	}
+	if protonDrive.CacheInconsistencyCount() != 0 {
+		t.Fatalf("no inconsistency expected, got %v", protonDrive.CacheInconsistencyCount())
+	}
+}
+
+func TestCacheInsertMissingLink(t *testing.T) {
+	protonDrive := &ProtonDrive{cache: newCache(true)}
+
+	if err := protonDrive.cache._insert("a", nil, nil); !errors.Is(err, ErrCacheInsertMissingLink) {
+		t.Fatalf("expected ErrCacheInsertMissingLink, got %v", err)
+	}
+	if protonDrive.cache._get("a") != nil {
+		t.Fatalf("nil link should not be cached")
+	}
+	if err := protonDrive.VerifyCache(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheRemoveHealsInconsistency(t *testing.T) {
+	protonDrive := &ProtonDrive{cache: newCache(true)}
+
+	for _, link := range []*proton.Link{
+		newTestLink("a", "root"),
+		newTestLink("b", "a"),
+		newTestLink("c", "b"),
+	} {
+		if err := protonDrive.cache._insert(link.LinkID, link, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// corrupt the bookkeeping
+	delete(protonDrive.cache.children, "a")
+	if err := protonDrive.VerifyCache(); !errors.Is(err, ErrCacheInconsistency) {
+		t.Fatalf("expected ErrCacheInconsistency, got %v", err)
+	}
+
+	// removing "b" without children should drop the whole subtree instead of crashing
+	err := protonDrive.cache._remove("b", false)
+	if !errors.Is(err, ErrCacheInconsistency) {
+		t.Fatalf("expected ErrCacheInconsistency, got %v", err)
+	}
+	if protonDrive.cache._get("c") != nil {
+		t.Fatalf("the inconsistent subtree should have been dropped")
+	}
+	if err := protonDrive.VerifyCache(); err != nil {
+		t.Fatal(err)
+	}
+	if protonDrive.CacheInconsistencyCount() != 1 {
+		t.Fatalf("expected 1 inconsistency, got %v", protonDrive.CacheInconsistencyCount())
+	}
+}
+
+func TestGetLinkSharesConcurrentFetches(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	protonDrive := &ProtonDrive{
+		MainShare: &proton.Share{},
+		cache:     newCache(true),
+		api: &fakeDriveAPI{
+			getLink: func(ctx context.Context, shareID, linkID string) (proton.Link, error) {
+				calls.Add(1)
+				<-release
+				if err := ctx.Err(); err != nil {
+					return proton.Link{}, err
+				}
+				return *newTestLink(linkID, "root"), nil
+			},
+		},
+	}
+
+	// the caller who starts the fetch gives up while it's in flight
+	ctx, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error)
+	go func() {
+		_, err := protonDrive.getLink(ctx, "a")
+		firstErr <- err
+	}()
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	const callers = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			link, err := protonDrive.getLink(context.Background(), "a")
+			if err == nil && link.LinkID != "a" {
+				t.Errorf("expected link a, got %v", link.LinkID)
+			}
+			errs <- err
+		}()
+	}
+
+	cancel()
+	if err := <-firstErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	// let the other callers join the fetch in flight
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("expected a single API call, got %v", calls.Load())
+	}
+}
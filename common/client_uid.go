@@ -0,0 +1,85 @@
+package common
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+The drafts are tagged with the ClientUID, so a failed upload of ours can be told apart from the one of another client.
+It must be stable across runs to be of any use. Callers which keep their own configuration, e.g. rclone, should generate it once,
+store it, and pass it in Config.ClientUID. Otherwise, a random one is generated and kept in the user's config directory,
+which is shared by all the processes of the user. If that directory isn't available, it only lasts as long as the process.
+*/
+
+// clientUIDFile doesn't depend on CredentialCacheFile, which most callers don't set
+func clientUIDFile() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(configDir, "proton-api-bridge", "clientuid"), nil
+}
+
+// newClientUID returns a random (version 4) UUID
+func newClientUID() (string, error) {
+	var uuid [16]byte
+	_, err := rand.Read(uuid[:])
+	if err != nil {
+		return "", err
+	}
+	uuid[6] = (uuid[6] & 0x0f) | 0x40
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16]), nil
+}
+
+// LoadClientUID sets config.ClientUID if it's empty, to the persisted one if any, or to a new one
+func LoadClientUID(config *Config) error {
+	if config.ClientUID != "" {
+		return nil
+	}
+
+	path, err := clientUIDFile()
+	if err != nil {
+		log.Println("The ClientUID can't be persisted, a new one will be used:", err)
+		path = ""
+	}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if clientUID := strings.TrimSpace(string(data)); clientUID != "" {
+			config.ClientUID = clientUID
+			return nil
+		}
+	}
+
+	clientUID, err := newClientUID()
+	if err != nil {
+		return err
+	}
+
+	if path != "" {
+		// a read-only home shouldn't prevent using the drive, the UID just won't survive the process
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+		if err == nil {
+			err = os.WriteFile(path, []byte(clientUID), 0600)
+		}
+		if err != nil {
+			log.Println("Failed to persist the ClientUID:", err)
+		}
+	}
+	config.ClientUID = clientUID
+
+	return nil
+}
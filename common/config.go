@@ -17,12 +17,22 @@ type Config struct {
 	CredentialCacheFile  string // If CredentialCacheFile is empty, no credential will be logged
 
 	/* Setting */
-	DestructiveIntegrationTest     bool // CAUTION: the integration test requires a clean proton drive
-	EmptyTrashAfterIntegrationTest bool // CAUTION: the integration test will clean up all the data in the trash
-	ReplaceExistingDraft           bool // for the file upload replace or keep it as-is option
-	EnableCaching                  bool // link node caching
+	DestructiveIntegrationTest     bool   // CAUTION: the integration test requires a clean proton drive
+	EmptyTrashAfterIntegrationTest bool   // CAUTION: the integration test will clean up all the data in the trash
+	ReplaceExistingDraft           bool   // for the file upload replace or keep it as-is option
+	ClientUID                      string // stable per installation. Our own failed upload attempts are replaced regardless of ReplaceExistingDraft. Callers should persist it, if ClientUID is empty, NewProtonDrive generates one and keeps it in the user config directory, see LoadClientUID
+	EnableCaching                  bool   // link node caching
 	ConcurrentBlockUploadCount     int
+	ConcurrentBlockDownloadCount   int
 	ConcurrentFileCryptoCount      int
+	DownloadReadAheadBlockCount    int    // 0 = download blocks one after another on Read, >0 = fetch and decrypt this many blocks ahead concurrently
+	BlockCacheDir                  string // If BlockCacheDir is empty, the encrypted blocks won't be cached on disk
+	BlockCacheMaxSize              int64  // in bytes, the least recently used blocks are evicted beyond it
+	UploadJournalDir               string // If UploadJournalDir is empty, the uploads can't be resumed with ResumeUpload
+	UploadSHA256Digest             bool   // record the SHA256 of the content in the revision xattr, next to the SHA1
+	UploadBlockRetryCount          int    // retries of a failed block upload, with exponential backoff, 0 = fail the upload on the first error
+	MemoryBudget                   int64  // in bytes, the blocks held in memory by all the uploads and downloads together, half of it for each, 0 = unlimited
+	SanitizeNames                  bool   // fix the names rejected by ValidateName where possible, e.g. "/" is replaced and the trailing spaces are trimmed, instead of failing
 
 	/* Drive */
 	DataFolderName string
@@ -65,9 +75,19 @@ func NewConfigWithDefaultValues() *Config {
 		DestructiveIntegrationTest:     false,
 		EmptyTrashAfterIntegrationTest: false,
 		ReplaceExistingDraft:           false,
+		ClientUID:                      "",
 		EnableCaching:                  true,
 		ConcurrentBlockUploadCount:     20, // let's be a nice citizen and not stress out proton engineers :)
+		ConcurrentBlockDownloadCount:   20,
 		ConcurrentFileCryptoCount:      runtime.GOMAXPROCS(0),
+		DownloadReadAheadBlockCount:    0, // rclone performs buffering / pre-fetching on its own
+		BlockCacheDir:                  "",
+		BlockCacheMaxSize:              1024 * 1024 * 1024, // 1 GB
+		UploadJournalDir:               "",
+		UploadSHA256Digest:             false,
+		UploadBlockRetryCount:          3,
+		MemoryBudget:                   0,
+		SanitizeNames:                  false,
 
 		DataFolderName: "data",
 	}
@@ -114,9 +134,19 @@ func NewConfigForIntegrationTests() *Config {
 		DestructiveIntegrationTest:     true,
 		EmptyTrashAfterIntegrationTest: true,
 		ReplaceExistingDraft:           false,
+		ClientUID:                      "",
 		EnableCaching:                  true,
 		ConcurrentBlockUploadCount:     20,
+		ConcurrentBlockDownloadCount:   20,
 		ConcurrentFileCryptoCount:      runtime.GOMAXPROCS(0),
+		DownloadReadAheadBlockCount:    0, // rclone performs buffering / pre-fetching on its own
+		BlockCacheDir:                  "",
+		BlockCacheMaxSize:              1024 * 1024 * 1024, // 1 GB
+		UploadJournalDir:               "",
+		UploadSHA256Digest:             false,
+		UploadBlockRetryCount:          3,
+		MemoryBudget:                   0,
+		SanitizeNames:                  false,
 
 		DataFolderName: "data",
 	}
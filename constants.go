@@ -13,7 +13,11 @@ var (
 
 	If you are not using rclone and instead is directly basing your work on this
 	library, then maybe you can increase this value to let the library does
-	the buffering work for you!
+	the buffering work for you! Or, set DownloadReadAheadBlockCount in the config
+	to have the blocks fetched and decrypted concurrently ahead of Read.
 	*/
 	DOWNLOAD_BATCH_BLOCK_SIZE = 1 
+
+	// number of recently decrypted blocks kept by a download reader for Seek and ReadAt
+	DOWNLOAD_CACHED_BLOCK_COUNT = 4
 )
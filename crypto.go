@@ -7,6 +7,7 @@ import (
 
 	"github.com/ProtonMail/gopenpgp/v2/crypto"
 	"github.com/ProtonMail/gopenpgp/v2/helper"
+	"github.com/ProtonMail/go-proton-api"
 )
 
 func generatePassphrase() (string, error) {
@@ -127,39 +128,80 @@ func getKeyRing(kr, addrKR *crypto.KeyRing, key, passphrase, passphraseSignature
 	return crypto.NewKeyRing(unlockedKey)
 }
 
-func decryptBlockIntoBuffer(sessionKey *crypto.SessionKey, addrKR, nodeKR *crypto.KeyRing, originalHash, encSignature string, buffer io.ReaderFrom, block io.ReadCloser) error {
-	data, err := io.ReadAll(block)
-	if err != nil {
-		return err
+// verifyManifestSignature checks that the blocks are complete and in order, and that the list of block hashes is signed by the uploader
+func verifyManifestSignature(revision *proton.Revision, addrKR *crypto.KeyRing) error {
+	manifestSignatureData := make([]byte, 0, len(revision.Blocks)*sha256.Size)
+	for i := range revision.Blocks {
+		// iOS drive: BE starts with 1
+		if revision.Blocks[i].Index != i+1 {
+			return ErrBlockListIncomplete
+		}
+
+		hash, err := base64.StdEncoding.DecodeString(revision.Blocks[i].Hash)
+		if err != nil {
+			return err
+		}
+		manifestSignatureData = append(manifestSignatureData, hash...)
 	}
 
-	plainMessage, err := sessionKey.Decrypt(data)
+	manifestSignature, err := crypto.NewPGPSignatureFromArmored(revision.ManifestSignature)
 	if err != nil {
 		return err
 	}
 
+	err = addrKR.VerifyDetached(crypto.NewPlainMessage(manifestSignatureData), manifestSignature, crypto.GetUnixTime())
+	if err == nil {
+		return nil
+	}
+
+	// revisions uploaded with a thumbnail by the official clients have the thumbnail hash prepended to the manifest
+	if revision.ThumbnailHash != "" {
+		thumbnailHash, err := base64.StdEncoding.DecodeString(revision.ThumbnailHash)
+		if err != nil {
+			return err
+		}
+
+		err = addrKR.VerifyDetached(crypto.NewPlainMessage(append(thumbnailHash, manifestSignatureData...)), manifestSignature, crypto.GetUnixTime())
+		if err == nil {
+			return nil
+		}
+	}
+
+	return ErrManifestSignatureVerificationFailed
+}
+
+// decryptBlockIntoBuffer streams the encrypted block through the session key decryption into buffer, hashing the ciphertext on the way.
+// The signature and the hash can only be checked at the end, so the content written into buffer must be discarded if an error is returned.
+func decryptBlockIntoBuffer(sessionKey *crypto.SessionKey, addrKR, nodeKR *crypto.KeyRing, originalHash, encSignature string, buffer io.Writer, block io.Reader) error {
 	encSignatureArm, err := crypto.NewPGPMessageFromArmored(encSignature)
 	if err != nil {
 		return err
 	}
+	signature, err := nodeKR.Decrypt(encSignatureArm, nil, 0)
+	if err != nil {
+		return err
+	}
 
-	err = addrKR.VerifyDetachedEncrypted(plainMessage, encSignatureArm, nodeKR, crypto.GetUnixTime())
+	h := sha256.New()
+	encDataReader := io.TeeReader(block, h)
+	plainMessageReader, err := sessionKey.DecryptStream(encDataReader, nil, crypto.GetUnixTime())
 	if err != nil {
 		return err
 	}
 
-	_, err = buffer.ReadFrom(plainMessage.NewReader())
+	err = addrKR.VerifyDetachedStream(io.TeeReader(plainMessageReader, buffer), crypto.NewPGPSignature(signature.GetBinary()), crypto.GetUnixTime())
 	if err != nil {
 		return err
 	}
 
-	h := sha256.New()
-	h.Write(data)
-	hash := h.Sum(nil)
-	base64Hash := base64.StdEncoding.EncodeToString(hash)
+	// make sure the whole block goes into the hash, even if the decryption didn't need all of it
+	_, err = io.Copy(io.Discard, encDataReader)
 	if err != nil {
 		return err
 	}
+
+	hash := h.Sum(nil)
+	base64Hash := base64.StdEncoding.EncodeToString(hash)
 	if base64Hash != originalHash {
 		return ErrDownloadedBlockHashVerificationFailed
 	}
@@ -0,0 +1,68 @@
+package proton_api_bridge
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+)
+
+func newTestKeyRing(t *testing.T) *crypto.KeyRing {
+	key, err := crypto.GenerateKey("Drive key", "noreply@protonmail.com", "x25519", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr, err := crypto.NewKeyRing(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return kr
+}
+
+func TestDecryptBlockIntoBuffer(t *testing.T) {
+	addrKR := newTestKeyRing(t)
+	nodeKR := newTestKeyRing(t)
+	sessionKey, err := crypto.GenerateSessionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	dataPlainMessage := crypto.NewPlainMessage(data)
+	encData, err := sessionKey.Encrypt(dataPlainMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encSignature, err := addrKR.SignDetachedEncrypted(dataPlainMessage, nodeKR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encSignatureStr, err := encSignature.GetArmored()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(encData)
+	base64Hash := base64.StdEncoding.EncodeToString(hash[:])
+
+	buffer := bytes.NewBuffer(nil)
+	err = decryptBlockIntoBuffer(sessionKey, addrKR, nodeKR, base64Hash, encSignatureStr, buffer, bytes.NewReader(encData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buffer.Bytes(), data) {
+		t.Fatalf("decrypted content is different from the original content")
+	}
+
+	err = decryptBlockIntoBuffer(sessionKey, addrKR, nodeKR, base64.StdEncoding.EncodeToString(make([]byte, sha256.Size)), encSignatureStr, bytes.NewBuffer(nil), bytes.NewReader(encData))
+	if err != ErrDownloadedBlockHashVerificationFailed {
+		t.Fatalf("expected ErrDownloadedBlockHashVerificationFailed, got %v", err)
+	}
+
+	err = decryptBlockIntoBuffer(sessionKey, newTestKeyRing(t), nodeKR, base64Hash, encSignatureStr, bytes.NewBuffer(nil), bytes.NewReader(encData))
+	if err == nil {
+		t.Fatalf("the signature of another key should not verify")
+	}
+}
@@ -2,7 +2,9 @@ package proton_api_bridge
 
 import (
 	"context"
+	"io"
 	"log"
+	"sync"
 
 	"github.com/henrybear327/Proton-API-Bridge/common"
 	"golang.org/x/sync/semaphore"
@@ -21,15 +23,32 @@ type ProtonDrive struct {
 	Config *common.Config
 
 	c                *proton.Client
+	api              driveAPI // c, except in the unit tests
 	m                *proton.Manager
 	userKR           *crypto.KeyRing
 	addrKRs          map[string]*crypto.KeyRing
 	addrData         map[string]proton.Address
 	signatureAddress string
 
-	cache                *cache
-	blockUploadSemaphore *semaphore.Weighted
-	blockCryptoSemaphore *semaphore.Weighted
+	cache                  *cache
+	blockCache             *blockCache   // nil if disabled
+	uploadMemoryBudget     *memoryBudget // nil if disabled
+	downloadMemoryBudget   *memoryBudget // nil if disabled
+	blockUploadSemaphore   *semaphore.Weighted
+	blockDownloadSemaphore *semaphore.Weighted
+	blockCryptoSemaphore   *semaphore.Weighted
+
+	// CreateRevision can't tag the revision drafts with the ClientUID, so we remember the ones we create, see isOwnRevisionDraft
+	ownRevisionDrafts sync.Map
+}
+
+// driveAPI is the part of *proton.Client which the unit tests fake
+type driveAPI interface {
+	GetLink(ctx context.Context, shareID, linkID string) (proton.Link, error)
+	GetBlock(ctx context.Context, bareURL, token string) (io.ReadCloser, error)
+	RequestBlockUpload(ctx context.Context, req proton.BlockUploadReq) ([]proton.BlockUploadLink, error)
+	UploadBlock(ctx context.Context, bareURL, token string, block io.Reader) error
+	CommitRevision(ctx context.Context, shareID, linkID, revisionID string, req proton.CommitRevisionReq) error
 }
 
 func NewDefaultConfig() *common.Config {
@@ -37,6 +56,11 @@ func NewDefaultConfig() *common.Config {
 }
 
 func NewProtonDrive(ctx context.Context, config *common.Config, authHandler proton.AuthHandler, deAuthHandler proton.Handler) (*ProtonDrive, *common.ProtonDriveCredential, error) {
+	err := common.LoadClientUID(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	/* Log in and logout */
 	m, c, credentials, userKR, addrKRs, addrData, err := common.Login(ctx, config, authHandler, deAuthHandler)
 	if err != nil {
@@ -130,6 +154,17 @@ func NewProtonDrive(ctx context.Context, config *common.Config, authHandler prot
 	}
 	// log.Println("mainShareKR CountDecryptionEntities", mainShareKR.CountDecryptionEntities())
 
+	var blockCache *blockCache
+	if config.BlockCacheDir != "" {
+		blockCache, err = newBlockCache(config.BlockCacheDir, config.BlockCacheMaxSize)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// a download is often piped into an upload, so they don't share the budget, see memory.go
+	uploadMemoryBudget, downloadMemoryBudget := newMemoryBudgets(config.MemoryBudget)
+
 	return &ProtonDrive{
 		MainShare: mainShare,
 		RootLink:  &rootLink,
@@ -140,15 +175,21 @@ func NewProtonDrive(ctx context.Context, config *common.Config, authHandler prot
 		Config: config,
 
 		c:                c,
+		api:              c,
 		m:                m,
 		userKR:           userKR,
 		addrKRs:          addrKRs,
 		addrData:         addrData,
 		signatureAddress: mainShare.Creator,
 
-		cache:                newCache(config.EnableCaching),
-		blockUploadSemaphore: semaphore.NewWeighted(int64(config.ConcurrentBlockUploadCount)),
-		blockCryptoSemaphore: semaphore.NewWeighted(int64(config.ConcurrentFileCryptoCount)),
+		cache:                  newCache(config.EnableCaching),
+		blockCache:             blockCache,
+		uploadMemoryBudget:     uploadMemoryBudget,
+		downloadMemoryBudget:   downloadMemoryBudget,
+		// a semaphore of weight 0 would block forever, e.g. with a Config which isn't from NewDefaultConfig
+		blockUploadSemaphore:   semaphore.NewWeighted(int64(max(config.ConcurrentBlockUploadCount, 1))),
+		blockDownloadSemaphore: semaphore.NewWeighted(int64(max(config.ConcurrentBlockDownloadCount, 1))),
+		blockCryptoSemaphore:   semaphore.NewWeighted(int64(max(config.ConcurrentFileCryptoCount, 1))),
 	}, credentials, nil
 }
 
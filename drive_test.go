@@ -1,9 +1,15 @@
 package proton_api_bridge
 
 import (
+	"errors"
+	"io"
 	"log"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/ProtonMail/go-proton-api"
 )
@@ -107,6 +113,37 @@ func TestPartialUploadAndReuploadFailedAndDownloadAndDeleteAFile(t *testing.T) {
 	// checkActiveFileListing(t, ctx, protonDrive, []string{})
 }
 
+func TestPartialUploadAndReuploadWithClientUIDAndDownloadAndDeleteAFile(t *testing.T) {
+	ctx, cancel, protonDrive := setup(t, false)
+	t.Cleanup(func() {
+		defer cancel()
+		defer tearDown(t, ctx, protonDrive)
+	})
+
+	log.Println("Create a new draft revision of integrationTestImage.png from client A")
+	protonDrive.Config.ClientUID = "integration-test-client-a"
+	uploadFileByFilepath(t, ctx, protonDrive, "", "integrationTestImage.png", "testcase/integrationTestImage.png", 1)
+	checkRevisions(protonDrive, ctx, t, "integrationTestImage.png", 1, 0, 1, 0)
+	checkActiveFileListing(t, ctx, protonDrive, []string{})
+
+	log.Println("Create a new draft revision of integrationTestImage.png from client B")
+	protonDrive.Config.ClientUID = "integration-test-client-b"
+	uploadFileByFilepathWithError(t, ctx, protonDrive, "", "integrationTestImage.png", "testcase/integrationTestImage.png", 1, ErrDraftExists)
+	checkRevisions(protonDrive, ctx, t, "integrationTestImage.png", 1, 0, 1, 0)
+	checkActiveFileListing(t, ctx, protonDrive, []string{})
+
+	log.Println("Replace the own draft revision of integrationTestImage.png from client A")
+	protonDrive.Config.ClientUID = "integration-test-client-a"
+	uploadFileByFilepath(t, ctx, protonDrive, "", "integrationTestImage.png", "testcase/integrationTestImage.png", 0)
+	checkRevisions(protonDrive, ctx, t, "integrationTestImage.png", 1, 1, 0, 0)
+	downloadFile(t, ctx, protonDrive, "", "integrationTestImage.png", "testcase/integrationTestImage.png", "")
+	checkActiveFileListing(t, ctx, protonDrive, []string{"/integrationTestImage.png"})
+
+	log.Println("Delete file integrationTestImage.png")
+	deleteBySearchingFromRoot(t, ctx, protonDrive, "integrationTestImage.png", false, false)
+	checkActiveFileListing(t, ctx, protonDrive, []string{})
+}
+
 func TestPartialUploadAndReuploadAndDownloadAndDeleteAFile(t *testing.T) {
 	ctx, cancel, protonDrive := setup(t, true)
 	t.Cleanup(func() {
@@ -456,3 +493,467 @@ func TestFileSeek(t *testing.T) {
 	deleteBySearchingFromRoot(t, ctx, protonDrive, filename, false, false)
 	checkActiveFileListing(t, ctx, protonDrive, []string{})
 }
+
+func TestUploadTwoRevisionsAndDownloadObsoleteRevision(t *testing.T) {
+	ctx, cancel, protonDrive := setup(t, false)
+	t.Cleanup(func() {
+		defer cancel()
+		defer tearDown(t, ctx, protonDrive)
+	})
+
+	ORIGINAL_UPLOAD_BLOCK_SIZE := UPLOAD_BLOCK_SIZE
+	defer func() {
+		UPLOAD_BLOCK_SIZE = ORIGINAL_UPLOAD_BLOCK_SIZE
+	}()
+	blocks := 10
+	UPLOAD_BLOCK_SIZE = 10
+
+	filename := "fileContent.txt"
+	file1Content := RandomString(UPLOAD_BLOCK_SIZE*blocks + 1)
+	file2Content := RandomString(UPLOAD_BLOCK_SIZE*blocks + 5)
+
+	log.Println("Upload fileContent.txt")
+	uploadFileByReader(t, ctx, protonDrive, "", filename, strings.NewReader(file1Content), 0)
+	checkRevisions(protonDrive, ctx, t, filename, 1, 1, 0, 0)
+
+	log.Println("Upload a new revision to replace fileContent.txt")
+	uploadFileByReader(t, ctx, protonDrive, "", filename, strings.NewReader(file2Content), 0)
+	checkRevisions(protonDrive, ctx, t, filename, 2, 1, 0, 1)
+	downloadFile(t, ctx, protonDrive, "", filename, "", file2Content)
+
+	log.Println("Download the obsolete revision of fileContent.txt")
+	downloadObsoleteRevision(t, ctx, protonDrive, filename, file1Content)
+
+	log.Println("Delete file fileContent.txt")
+	deleteBySearchingFromRoot(t, ctx, protonDrive, filename, false, false)
+	checkActiveFileListing(t, ctx, protonDrive, []string{})
+}
+
+func TestDownloadToFileAndResume(t *testing.T) {
+	ctx, cancel, protonDrive := setup(t, false)
+	t.Cleanup(func() {
+		defer cancel()
+		defer tearDown(t, ctx, protonDrive)
+	})
+
+	ORIGINAL_UPLOAD_BLOCK_SIZE := UPLOAD_BLOCK_SIZE
+	defer func() {
+		UPLOAD_BLOCK_SIZE = ORIGINAL_UPLOAD_BLOCK_SIZE
+	}()
+	blocks := 10
+	UPLOAD_BLOCK_SIZE = 10
+
+	filename := "fileContent.txt"
+	file1Content := RandomString(UPLOAD_BLOCK_SIZE*blocks + 5)
+
+	log.Println("Upload fileContent.txt")
+	uploadFileByReader(t, ctx, protonDrive, "", filename, strings.NewReader(file1Content), 0)
+	checkRevisions(protonDrive, ctx, t, filename, 1, 1, 0, 0)
+
+	targetFileLink, err := protonDrive.searchByNameRecursivelyFromRoot(ctx, filename, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if targetFileLink == nil {
+		t.Fatalf("File %v not found", filename)
+	}
+
+	log.Println("Download fileContent.txt to a local file")
+	path := filepath.Join(t.TempDir(), filename)
+	downloadToFile(t, ctx, protonDrive, targetFileLink, path, file1Content)
+
+	log.Println("Resume an interrupted download of fileContent.txt")
+	revisions, err := protonDrive.GetRevisions(ctx, targetFileLink, proton.RevisionStateActive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first block has been verified, followed by some half-written content
+	err = os.WriteFile(path+DOWNLOAD_PARTIAL_FILE_SUFFIX, []byte(file1Content[:UPLOAD_BLOCK_SIZE]+"garbage"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeDownloadCheckpoint(path+DOWNLOAD_CHECKPOINT_FILE_SUFFIX, &downloadCheckpoint{
+		LinkID:         targetFileLink.LinkID,
+		RevisionID:     revisions[0].ID,
+		VerifiedBlocks: []int{1},
+		VerifiedBytes:  int64(UPLOAD_BLOCK_SIZE),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloadToFile(t, ctx, protonDrive, targetFileLink, path, file1Content)
+
+	log.Println("Delete file fileContent.txt")
+	deleteBySearchingFromRoot(t, ctx, protonDrive, filename, false, false)
+	checkActiveFileListing(t, ctx, protonDrive, []string{})
+}
+
+func TestDownloadToWriterAt(t *testing.T) {
+	ctx, cancel, protonDrive := setup(t, false)
+	t.Cleanup(func() {
+		defer cancel()
+		defer tearDown(t, ctx, protonDrive)
+	})
+
+	ORIGINAL_UPLOAD_BLOCK_SIZE := UPLOAD_BLOCK_SIZE
+	defer func() {
+		UPLOAD_BLOCK_SIZE = ORIGINAL_UPLOAD_BLOCK_SIZE
+	}()
+	blocks := 100
+	UPLOAD_BLOCK_SIZE = 10
+
+	filename := "fileContent.txt"
+	file1Content := RandomString(UPLOAD_BLOCK_SIZE*blocks + 5)
+
+	log.Println("Upload fileContent.txt")
+	uploadFileByReader(t, ctx, protonDrive, "", filename, strings.NewReader(file1Content), 0)
+	checkRevisions(protonDrive, ctx, t, filename, 1, 1, 0, 0)
+
+	targetFileLink, err := protonDrive.searchByNameRecursivelyFromRoot(ctx, filename, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if targetFileLink == nil {
+		t.Fatalf("File %v not found", filename)
+	}
+
+	log.Println("Download fileContent.txt out of order")
+	path := filepath.Join(t.TempDir(), filename)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = protonDrive.DownloadTo(ctx, targetFileLink, f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloadedData, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(downloadedData) != file1Content {
+		t.Fatalf("Downloaded content is different from the original content")
+	}
+
+	log.Println("Delete file fileContent.txt")
+	deleteBySearchingFromRoot(t, ctx, protonDrive, filename, false, false)
+	checkActiveFileListing(t, ctx, protonDrive, []string{})
+}
+
+func TestPartialUploadAndResumeAndDownloadAndDeleteAFile(t *testing.T) {
+	ctx, cancel, protonDrive := setup(t, false)
+	t.Cleanup(func() {
+		defer cancel()
+		defer tearDown(t, ctx, protonDrive)
+	})
+	protonDrive.Config.UploadJournalDir = t.TempDir()
+
+	ORIGINAL_UPLOAD_BLOCK_SIZE := UPLOAD_BLOCK_SIZE
+	defer func() {
+		UPLOAD_BLOCK_SIZE = ORIGINAL_UPLOAD_BLOCK_SIZE
+	}()
+	blocks := 100
+	UPLOAD_BLOCK_SIZE = 10
+
+	filename := "fileContent.txt"
+	file1Content := RandomString(UPLOAD_BLOCK_SIZE*blocks + 5)
+
+	log.Println("Upload fileContent.txt and fail half way through")
+	failingReader := io.MultiReader(strings.NewReader(file1Content[:len(file1Content)/2]), iotest.ErrReader(io.ErrClosedPipe))
+	_, _, err := protonDrive.UploadFileByReader(ctx, protonDrive.RootLink.LinkID, filename, time.Now(), failingReader, 0)
+	if err != io.ErrClosedPipe {
+		t.Fatalf("expected io.ErrClosedPipe, got %v", err)
+	}
+	checkRevisions(protonDrive, ctx, t, filename, 1, 0, 1, 0)
+
+	log.Println("Resume the upload of fileContent.txt with different content")
+	_, _, err = protonDrive.ResumeUpload(ctx, protonDrive.RootLink.LinkID, filename, strings.NewReader(RandomString(len(file1Content))), nil)
+	if err != ErrUploadSourceChanged {
+		t.Fatalf("expected ErrUploadSourceChanged, got %v", err)
+	}
+
+	log.Println("Resume the upload of fileContent.txt")
+	_, _, err = protonDrive.ResumeUpload(ctx, protonDrive.RootLink.LinkID, filename, strings.NewReader(file1Content), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRevisions(protonDrive, ctx, t, filename, 1, 1, 0, 0)
+	checkActiveFileListing(t, ctx, protonDrive, []string{"/" + filename})
+	downloadFile(t, ctx, protonDrive, "", filename, "", file1Content)
+
+	log.Println("Nothing left to resume")
+	_, _, err = protonDrive.ResumeUpload(ctx, protonDrive.RootLink.LinkID, filename, strings.NewReader(file1Content), nil)
+	if err != ErrUploadJournalNotFound {
+		t.Fatalf("expected ErrUploadJournalNotFound, got %v", err)
+	}
+
+	log.Println("Delete file fileContent.txt")
+	deleteBySearchingFromRoot(t, ctx, protonDrive, filename, false, false)
+	checkActiveFileListing(t, ctx, protonDrive, []string{})
+}
+
+func TestKeepBothUploadAndCreateFolderAndMove(t *testing.T) {
+	ctx, cancel, protonDrive := setup(t, false)
+	t.Cleanup(func() {
+		defer cancel()
+		defer tearDown(t, ctx, protonDrive)
+	})
+
+	opts := &UploadOptions{ConflictPolicy: ConflictPolicyKeepBoth}
+	for _, expectedName := range []string{"fileContent.txt", "fileContent (1).txt", "fileContent (2).txt"} {
+		log.Println("Upload fileContent.txt, keeping both")
+		_, name, _, err := protonDrive.UploadFileWithOptions(ctx, protonDrive.RootLink, "fileContent.txt", time.Now(), strings.NewReader(expectedName), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != expectedName {
+			t.Fatalf("expected %v, got %v", expectedName, name)
+		}
+		checkRevisions(protonDrive, ctx, t, name, 1, 1, 0, 0)
+		downloadFile(t, ctx, protonDrive, "", name, "", expectedName)
+	}
+
+	log.Println("Upload fileContent.txt, failing on conflict")
+	_, _, _, err := protonDrive.UploadFileWithOptions(ctx, protonDrive.RootLink, "fileContent.txt", time.Now(), strings.NewReader("conflict"), &UploadOptions{ConflictPolicy: ConflictPolicyFail})
+	if err != proton.ErrFileNameExist {
+		t.Fatalf("expected proton.ErrFileNameExist, got %v", err)
+	}
+
+	log.Println("Create a folder tmp at root twice, keeping both")
+	createFolder(t, ctx, protonDrive, "", "tmp")
+	_, name, err := protonDrive.CreateNewFolderWithConflictPolicy(ctx, protonDrive.RootLink, "tmp", ConflictPolicyKeepBoth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "tmp (1)" {
+		t.Fatalf("expected tmp (1), got %v", name)
+	}
+
+	log.Println("Move fileContent (1).txt into tmp as fileContent.txt, then move fileContent.txt after it, keeping both")
+	dstParentLink, err := protonDrive.searchByNameRecursivelyFromRoot(ctx, "tmp", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// look both up before moving, as there are two fileContent.txt after the first move
+	srcLinks := make([]*proton.Link, 0)
+	for _, srcName := range []string{"fileContent (1).txt", "fileContent.txt"} {
+		srcLink, err := protonDrive.searchByNameRecursivelyFromRoot(ctx, srcName, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srcLinks = append(srcLinks, srcLink)
+	}
+	for i, expectedName := range []string{"fileContent.txt", "fileContent (1).txt"} {
+		name, err := protonDrive.MoveFileWithConflictPolicy(ctx, srcLinks[i], dstParentLink, "fileContent.txt", ConflictPolicyKeepBoth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != expectedName {
+			t.Fatalf("expected %v, got %v", expectedName, name)
+		}
+	}
+	checkActiveFileListing(t, ctx, protonDrive, []string{"/fileContent (2).txt", "/tmp", "/tmp (1)", "/tmp/fileContent.txt", "/tmp/fileContent (1).txt"})
+
+	log.Println("Delete everything")
+	deleteBySearchingFromRoot(t, ctx, protonDrive, "fileContent (2).txt", false, false)
+	deleteBySearchingFromRoot(t, ctx, protonDrive, "tmp", true, false)
+	deleteBySearchingFromRoot(t, ctx, protonDrive, "tmp (1)", true, false)
+	checkActiveFileListing(t, ctx, protonDrive, []string{})
+}
+
+func TestUploadIfChangedAndDeleteAFile(t *testing.T) {
+	ctx, cancel, protonDrive := setup(t, false)
+	t.Cleanup(func() {
+		defer cancel()
+		defer tearDown(t, ctx, protonDrive)
+	})
+
+	filename := "fileContent.txt"
+	modTime := time.Now()
+
+	log.Println("Upload fileContent.txt")
+	_, _, _, status, err := protonDrive.UploadFileIfChanged(ctx, protonDrive.RootLink, filename, modTime, strings.NewReader("fileContent"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != UploadStatusUploaded {
+		t.Fatalf("expected the new file to be uploaded, got %v", status)
+	}
+	checkRevisions(protonDrive, ctx, t, filename, 1, 1, 0, 0)
+
+	log.Println("Upload the same fileContent.txt")
+	_, _, _, status, err = protonDrive.UploadFileIfChanged(ctx, protonDrive.RootLink, filename, modTime, strings.NewReader("fileContent"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != UploadStatusUnchanged {
+		t.Fatalf("expected the unchanged file to be skipped, got %v", status)
+	}
+	checkRevisions(protonDrive, ctx, t, filename, 1, 1, 0, 0)
+
+	log.Println("Upload the same fileContent.txt, with a different modification time")
+	_, _, _, status, err = protonDrive.UploadFileIfChanged(ctx, protonDrive.RootLink, filename, modTime.Add(time.Hour), strings.NewReader("fileContent"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != UploadStatusModTimeStale {
+		t.Fatalf("expected the unchanged file to be skipped with a stale modification time, got %v", status)
+	}
+	checkRevisions(protonDrive, ctx, t, filename, 1, 1, 0, 0)
+
+	log.Println("Upload a changed fileContent.txt")
+	_, _, _, status, err = protonDrive.UploadFileIfChanged(ctx, protonDrive.RootLink, filename, modTime.Add(time.Hour), strings.NewReader("fileContenT"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != UploadStatusUploaded {
+		t.Fatalf("expected the changed file to be uploaded, got %v", status)
+	}
+	checkRevisions(protonDrive, ctx, t, filename, 2, 1, 0, 1)
+	downloadFile(t, ctx, protonDrive, "", filename, "", "fileContenT")
+
+	log.Println("Delete file fileContent.txt")
+	deleteBySearchingFromRoot(t, ctx, protonDrive, filename, false, false)
+	checkActiveFileListing(t, ctx, protonDrive, []string{})
+}
+
+func TestUploadNewRevisionAfterRenameAndDeleteAFile(t *testing.T) {
+	ctx, cancel, protonDrive := setup(t, false)
+	t.Cleanup(func() {
+		defer cancel()
+		defer tearDown(t, ctx, protonDrive)
+	})
+
+	log.Println("Upload fileContent.txt")
+	linkID, _, err := protonDrive.UploadFileByReader(ctx, protonDrive.RootLink.LinkID, "fileContent.txt", time.Now(), strings.NewReader("fileContent"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log.Println("Rename fileContent.txt to renamed.txt")
+	link, err := protonDrive.getLink(ctx, linkID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = protonDrive.MoveFile(ctx, link, protonDrive.RootLink, "renamed.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log.Println("Upload a new revision into the same link")
+	_, err = protonDrive.UploadNewRevision(ctx, linkID, time.Now(), strings.NewReader("newFileContent"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRevisions(protonDrive, ctx, t, "renamed.txt", 2, 1, 0, 1)
+	checkActiveFileListing(t, ctx, protonDrive, []string{"/renamed.txt"})
+	downloadFile(t, ctx, protonDrive, "", "renamed.txt", "", "newFileContent")
+
+	log.Println("Delete file renamed.txt")
+	deleteBySearchingFromRoot(t, ctx, protonDrive, "renamed.txt", false, false)
+	checkActiveFileListing(t, ctx, protonDrive, []string{})
+}
+
+func TestReuploadWithUnnormalizedNameAndDeleteAFile(t *testing.T) {
+	ctx, cancel, protonDrive := setup(t, false)
+	t.Cleanup(func() {
+		defer cancel()
+		defer tearDown(t, ctx, protonDrive)
+	})
+
+	nfdName := "cafe\u0301.txt"
+
+	log.Println("Upload a file with a NFD name, as it was done before the names got normalized")
+	linkID, revisionID, _, sessionKey, nodeKR, err := protonDrive.createFileUploadDraft(ctx, protonDrive.RootLink, nfdName, nfdName, time.Now(), "text/plain", ConflictPolicyDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = protonDrive.uploadIntoDraft(ctx, linkID, revisionID, sessionKey, nodeKR, nil, strings.NewReader("fileContent"), time.Now(), time.Time{}, NopProgressReporter{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRevisions(protonDrive, ctx, t, nfdName, 1, 1, 0, 0)
+	checkActiveFileListing(t, ctx, protonDrive, []string{"/" + nfdName})
+
+	log.Println("Upload the file with the NFD name again")
+	newLinkID, name, _, err := protonDrive.UploadFileWithOptions(ctx, protonDrive.RootLink, nfdName, time.Now(), strings.NewReader("newFileContent"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newLinkID != linkID || name != nfdName {
+		t.Fatalf("expected a new revision of %v %q, got %v %q", linkID, nfdName, newLinkID, name)
+	}
+	checkRevisions(protonDrive, ctx, t, nfdName, 2, 1, 0, 1)
+	checkActiveFileListing(t, ctx, protonDrive, []string{"/" + nfdName})
+	downloadFile(t, ctx, protonDrive, "", nfdName, "", "newFileContent")
+
+	log.Println("Upload the file with the NFD name again, failing on conflicts")
+	_, _, _, err = protonDrive.UploadFileWithOptions(ctx, protonDrive.RootLink, nfdName, time.Now(), strings.NewReader("conflict"), &UploadOptions{ConflictPolicy: ConflictPolicyFail})
+	if err != proton.ErrFileNameExist {
+		t.Fatalf("expected proton.ErrFileNameExist, got %v", err)
+	}
+	checkRevisions(protonDrive, ctx, t, nfdName, 2, 1, 0, 1)
+
+	log.Println("Delete file " + nfdName)
+	deleteBySearchingFromRoot(t, ctx, protonDrive, nfdName, false, false)
+	checkActiveFileListing(t, ctx, protonDrive, []string{})
+}
+
+func TestUploadWithUnnormalizedAndInvalidNames(t *testing.T) {
+	ctx, cancel, protonDrive := setup(t, false)
+	t.Cleanup(func() {
+		defer cancel()
+		defer tearDown(t, ctx, protonDrive)
+	})
+
+	nfdName := "cafe\u0301.txt"
+	nfcName := "caf\u00e9.txt"
+
+	log.Println("Upload a file with a NFD name")
+	_, name, _, err := protonDrive.UploadFileWithOptions(ctx, protonDrive.RootLink, nfdName, time.Now(), strings.NewReader("fileContent"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != nfcName {
+		t.Fatalf("expected the name to be normalized, got %q", name)
+	}
+	checkActiveFileListing(t, ctx, protonDrive, []string{"/" + nfcName})
+
+	log.Println("Look up the file by both forms")
+	for _, targetName := range []string{nfdName, nfcName} {
+		link, err := protonDrive.SearchByNameInActiveFolder(ctx, protonDrive.RootLink, targetName, true, false, proton.LinkStateActive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if link == nil {
+			t.Fatalf("expected to find %q", targetName)
+		}
+	}
+
+	log.Println("Upload a file and create a folder with invalid names")
+	_, _, _, err = protonDrive.UploadFileWithOptions(ctx, protonDrive.RootLink, "a/b.txt", time.Now(), strings.NewReader("fileContent"), nil)
+	if !errors.Is(err, ErrNameContainsSlash) {
+		t.Fatalf("expected ErrNameContainsSlash, got %v", err)
+	}
+	_, err = protonDrive.CreateNewFolder(ctx, protonDrive.RootLink, "tmp ")
+	if !errors.Is(err, ErrNameEndsWithSpace) {
+		t.Fatalf("expected ErrNameEndsWithSpace, got %v", err)
+	}
+
+	log.Println("Create folder \"tmp \" with the names sanitized")
+	protonDrive.Config.SanitizeNames = true
+	_, name, err = protonDrive.CreateNewFolderWithConflictPolicy(ctx, protonDrive.RootLink, "tmp ", ConflictPolicyFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "tmp" {
+		t.Fatalf("expected tmp, got %q", name)
+	}
+	checkActiveFileListing(t, ctx, protonDrive, []string{"/" + nfcName, "/tmp"})
+
+	log.Println("Delete the file and folder tmp")
+	deleteBySearchingFromRoot(t, ctx, protonDrive, nfcName, false, false)
+	deleteBySearchingFromRoot(t, ctx, protonDrive, "tmp", true, false)
+	checkActiveFileListing(t, ctx, protonDrive, []string{})
+}
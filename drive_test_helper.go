@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	"os"
 	"testing"
@@ -178,7 +179,7 @@ func uploadFileByFilepathWithError(t *testing.T, ctx context.Context, protonDriv
 	in := bufio.NewReader(f)
 
 	_, _, err = protonDrive.UploadFileByReader(ctx, parentLink.LinkID, name, info.ModTime(), in, testParam)
-	if err != expectedError {
+	if !errors.Is(err, expectedError) {
 		t.Fatal(err)
 	}
 }
@@ -396,3 +397,61 @@ func moveFile(t *testing.T, ctx context.Context, protonDrive *ProtonDrive, srcFi
 		}
 	}
 }
+
+func downloadObsoleteRevision(t *testing.T, ctx context.Context, protonDrive *ProtonDrive, name string, data string) {
+	targetFileLink, err := protonDrive.searchByNameRecursivelyFromRoot(ctx, name, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if targetFileLink == nil {
+		t.Fatalf("File %v not found", name)
+	}
+
+	revisions, err := protonDrive.GetRevisions(ctx, targetFileLink, proton.RevisionStateObsolete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 1 {
+		t.Fatalf("Expected 1 obsolete revision, got %v", len(revisions))
+	}
+
+	reader, _, fileSystemAttr, err := protonDrive.DownloadRevision(ctx, targetFileLink, revisions[0].ID, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	downloadedData, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fileSystemAttr == nil {
+		t.Fatalf("FileSystemAttr should not be nil")
+	} else if len(downloadedData) != int(fileSystemAttr.Size) {
+		t.Fatalf("Downloaded file size != uploaded file size: %#v vs %#v", len(downloadedData), int(fileSystemAttr.Size))
+	}
+
+	if !bytes.Equal(downloadedData, []byte(data)) {
+		t.Fatalf("Downloaded content is different from the original content")
+	}
+}
+
+func downloadToFile(t *testing.T, ctx context.Context, protonDrive *ProtonDrive, link *proton.Link, path string, data string) {
+	_, err := protonDrive.DownloadToFile(ctx, link, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	downloadedData, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloadedData, []byte(data)) {
+		t.Fatalf("Downloaded content is different from the original content")
+	}
+
+	if _, err := os.Stat(path + DOWNLOAD_CHECKPOINT_FILE_SUFFIX); !os.IsNotExist(err) {
+		t.Fatalf("The checkpoint should be removed after a successful download")
+	}
+}
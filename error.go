@@ -1,6 +1,10 @@
 package proton_api_bridge
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 var (
 	ErrMainSharePreconditionsFailed          = errors.New("the main share assumption has failed")
@@ -14,11 +18,85 @@ var (
 	ErrLinkMustNotBeNil                      = errors.New("missing input proton link")
 	ErrLinkMustBeActive                      = errors.New("can not operate on link state other than active")
 	ErrDownloadedBlockHashVerificationFailed = errors.New("the hash of the downloaded block doesn't match the original hash")
+	ErrDownloadedFileIntegrityCheckFailed    = errors.New("the downloaded file doesn't match the size or digest recorded at upload")
+	ErrManifestSignatureVerificationFailed   = errors.New("the manifest signature over the block hashes of the revision can't be verified")
+	ErrBlockListIncomplete                   = errors.New("the block list of the revision is incomplete or out of order")
 	ErrDraftExists                           = errors.New("a draft exist - usually this means a file is being uploaded at another client, or, there was a failed upload attempt. Can use --protondrive-replace-existing-draft=true to temporarily override the existing draft")
 	ErrCantFindActiveRevision                = errors.New("can't find an active revision")
 	ErrCantFindDraftRevision                 = errors.New("can't find a draft revision")
+	ErrCantFindRevision                      = errors.New("can't find the requested revision")
+	ErrRevisionMustBeActiveOrObsolete        = errors.New("can only download an active or obsolete revision")
 	ErrWrongUsageOfGetLinkKR                 = errors.New("internal error for GetLinkKR - nil passed in for link")
 	ErrWrongUsageOfGetLink                   = errors.New("internal error for getLink - empty linkID passed in")
 	ErrSeekOffsetAfterSkippingBlocks         = errors.New("internal error for download seek - the offset after skipping blocks is wrong")
 	ErrNoKeyringForSignatureVerification     = errors.New(("internal error for signature verification - no keyring is generated"))
+	ErrDownloadReaderClosed                  = errors.New("the download reader has been closed")
+	ErrRandomAccessWithoutBlockSizes         = errors.New("random access requires the block sizes of the file, which are missing from the metadata")
+	ErrInvalidSeekWhence                     = errors.New("invalid whence for seek")
+	ErrNegativeSeekOffset                    = errors.New("seek offset must not be negative")
+	ErrInvalidDownloadRange                  = errors.New("the download range is not satisfiable")
+	ErrCacheInconsistency                    = errors.New("internal error for cache - the cached links and the children map disagree")
+	ErrCacheInsertMissingLink                = errors.New("internal error for cache - nil passed in for link")
+	ErrUploadJournalDirIsEmpty               = errors.New("please supply an UploadJournalDir to enable resumable uploads")
+	ErrUploadJournalNotFound                 = errors.New("there is no upload to resume for this file")
+	ErrUploadJournalMismatch                 = errors.New("the upload journal doesn't match the draft or the configuration anymore")
+	ErrUploadJournalStale                    = errors.New("the draft revision recorded in the upload journal doesn't exist anymore")
+	ErrUploadSourceChanged                   = errors.New("the content of the already uploaded blocks doesn't match the source anymore")
+	ErrNoAvailableName                       = errors.New("can't find a free name in the folder to keep both")
+	ErrInvalidConflictPolicy                 = errors.New("the conflict policy only applies to uploads")
+	ErrInvalidName                           = errors.New("the name can't be used in Proton Drive")
+	ErrNameEmpty                             = errors.New("the name must not be empty")
+	ErrNameReserved                          = errors.New("the name must not be \".\" or \"..\"")
+	ErrNameContainsSlash                     = errors.New("the name must not contain \"/\"")
+	ErrNameTooLong                           = errors.New("the name must be 255 characters long at most")
+	ErrNameEndsWithSpace                     = errors.New("the name must not end with a space")
+	ErrNameInvalidUTF8                       = errors.New("the name must be valid UTF-8")
 )
+
+// DraftExistsError is returned when the file has a draft revision which isn't ours to replace
+type DraftExistsError struct {
+	ClientUID string // of the client which created the draft, empty if unknown
+	Age       time.Duration
+}
+
+func (e *DraftExistsError) Error() string {
+	clientUID := e.ClientUID
+	if clientUID == "" {
+		clientUID = "unknown"
+	}
+
+	return fmt.Sprintf("%v (draft created %v ago by client %v)", ErrDraftExists, e.Age, clientUID)
+}
+
+func (e *DraftExistsError) Unwrap() error {
+	return ErrDraftExists
+}
+
+// FileIntegrityError is returned at EOF when the content read doesn't match the revision xattr
+type FileIntegrityError struct {
+	Field    string // "Size", "SHA1", or "BlockSizes"
+	Expected string
+	Actual   string
+}
+
+func (e *FileIntegrityError) Error() string {
+	return fmt.Sprintf("%v: %v mismatch, expected %v but got %v", ErrDownloadedFileIntegrityCheckFailed, e.Field, e.Expected, e.Actual)
+}
+
+func (e *FileIntegrityError) Unwrap() error {
+	return ErrDownloadedFileIntegrityCheckFailed
+}
+
+// InvalidNameError is returned when a name is rejected by ValidateName, errors.Is matches both ErrInvalidName and the Reason
+type InvalidNameError struct {
+	Name   string
+	Reason error // ErrNameEmpty, ErrNameReserved, ErrNameContainsSlash, ErrNameTooLong, ErrNameEndsWithSpace, or ErrNameInvalidUTF8
+}
+
+func (e *InvalidNameError) Error() string {
+	return fmt.Sprintf("%v: %q, %v", ErrInvalidName, e.Name, e.Reason)
+}
+
+func (e *InvalidNameError) Unwrap() []error {
+	return []error{ErrInvalidName, e.Reason}
+}
@@ -2,18 +2,85 @@ package proton_api_bridge
 
 import (
 	"context"
+	"encoding/json"
 	"strings"
 	"time"
 
 	"github.com/ProtonMail/go-proton-api"
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
 	"github.com/relvacode/iso8601"
 )
 
 type FileSystemAttrs struct {
-	ModificationTime time.Time
+	ModificationTime time.Time // nanosecond precision if uploaded by us, second precision otherwise
+	CreationTime     time.Time // zero if not recorded
 	Size             int64
 	BlockSizes       []int64
 	Digests          string // sha1 string
+	SHA256           string // sha256 string, empty if not recorded
+}
+
+// ISO8601, with as many fractional second digits as needed, so the official clients can still parse it
+const XATTR_TIME_FORMAT = "2006-01-02T15:04:05.999999999-0700"
+
+/*
+revisionXAttrCommon is the Common section of the revision xattr, with the fields the official clients don't know about.
+
+The xattr is encrypted and signed the same way as by proton.CommitRevisionReq.SetEncXAttrString,
+which can only write the fields of proton.RevisionXAttrCommon. The official clients ignore the extra fields.
+*/
+type revisionXAttrCommon struct {
+	proton.RevisionXAttrCommon
+	CreationTime string `json:",omitempty"`
+}
+
+type revisionXAttr struct {
+	Common revisionXAttrCommon
+}
+
+func encryptRevisionXAttr(addrKR, nodeKR *crypto.KeyRing, xAttrCommon *revisionXAttrCommon) (string, error) {
+	data, err := json.Marshal(revisionXAttr{
+		Common: *xAttrCommon,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	/*
+		Encryption: current link's node key
+		Signature: share's signature address keys
+	*/
+	encXAttr, err := nodeKR.Encrypt(crypto.NewPlainMessage(data), addrKR)
+	if err != nil {
+		return "", err
+	}
+
+	return encXAttr.GetArmored()
+}
+
+// decryptRevisionXAttr returns nil if the xattr is missing
+func decryptRevisionXAttr(addrKR, nodeKR *crypto.KeyRing, xAttr *string) (*revisionXAttrCommon, error) {
+	if xAttr == nil {
+		return nil, nil
+	}
+
+	encXAttr, err := crypto.NewPGPMessageFromArmored(*xAttr)
+	if err != nil {
+		return nil, err
+	}
+
+	decXAttr, err := nodeKR.Decrypt(encXAttr, addrKR, crypto.GetUnixTime())
+	if err != nil {
+		return nil, err
+	}
+
+	var data revisionXAttr
+	err = json.Unmarshal(decXAttr.GetBinary(), &data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &data.Common, nil
 }
 
 func (protonDrive *ProtonDrive) GetRevisions(ctx context.Context, link *proton.Link, revisionType proton.RevisionState) ([]*proton.RevisionMetadata, error) {
@@ -45,6 +112,20 @@ func (protonDrive *ProtonDrive) GetActiveRevisionAttrsByID(ctx context.Context,
 
 // Might return nil when xattr is missing
 func (protonDrive *ProtonDrive) GetActiveRevisionAttrs(ctx context.Context, link *proton.Link) (*FileSystemAttrs, error) {
+	revisionXAttrCommon, err := protonDrive.getActiveRevisionXAttrCommon(ctx, link)
+	if err != nil {
+		return nil, err
+	}
+
+	if revisionXAttrCommon == nil {
+		return nil, nil
+	}
+
+	return newFileSystemAttrs(revisionXAttrCommon)
+}
+
+// Might return nil when xattr is missing
+func (protonDrive *ProtonDrive) getActiveRevisionXAttrCommon(ctx context.Context, link *proton.Link) (*revisionXAttrCommon, error) {
 	if link == nil {
 		return nil, ErrLinkMustNotBeNil
 	}
@@ -61,20 +142,24 @@ func (protonDrive *ProtonDrive) GetActiveRevisionAttrs(ctx context.Context, link
 	if err != nil {
 		return nil, err
 	}
-	revisionXAttrCommon, err := revisionMetadata.GetDecXAttrString(signatureVerificationKR, nodeKR)
-	if err != nil {
-		return nil, err
-	}
 
-	if revisionXAttrCommon == nil {
-		return nil, nil
-	}
+	return decryptRevisionXAttr(signatureVerificationKR, nodeKR, revisionMetadata.XAttr)
+}
 
+func newFileSystemAttrs(revisionXAttrCommon *revisionXAttrCommon) (*FileSystemAttrs, error) {
 	modificationTime, err := iso8601.ParseString(revisionXAttrCommon.ModificationTime)
 	if err != nil {
 		return nil, err
 	}
 
+	var creationTime time.Time
+	if revisionXAttrCommon.CreationTime != "" {
+		creationTime, err = iso8601.ParseString(revisionXAttrCommon.CreationTime)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	var sha1Hash string
 	if val, ok := revisionXAttrCommon.Digests["SHA1"]; ok {
 		sha1Hash = strings.ToLower(val) // https://github.com/henrybear327/Proton-API-Bridge/issues/21 and https://github.com/rclone/rclone/issues/7345#issuecomment-1821463100
@@ -84,9 +169,11 @@ func (protonDrive *ProtonDrive) GetActiveRevisionAttrs(ctx context.Context, link
 
 	return &FileSystemAttrs{
 		ModificationTime: modificationTime,
+		CreationTime:     creationTime,
 		Size:             revisionXAttrCommon.Size,
 		BlockSizes:       revisionXAttrCommon.BlockSizes,
 		Digests:          sha1Hash,
+		SHA256:           strings.ToLower(revisionXAttrCommon.Digests["SHA256"]),
 	}, nil
 }
 
@@ -104,41 +191,65 @@ func (protonDrive *ProtonDrive) GetActiveRevisionWithAttrs(ctx context.Context,
 		return nil, nil, ErrCantFindActiveRevision
 	}
 
-	revision, err := protonDrive.c.GetRevisionAllBlocks(ctx, protonDrive.MainShare.ShareID, link.LinkID, revisionsMetadata[0].ID)
+	return protonDrive.getRevisionWithAttrs(ctx, link, revisionsMetadata[0])
+}
+
+// GetRevisionWithAttrs works on active and obsolete revisions alike, e.g. for restoring an older version of a file.
+// The returned attrs might be nil when xattr is missing.
+func (protonDrive *ProtonDrive) GetRevisionWithAttrs(ctx context.Context, link *proton.Link, revisionID string) (*proton.Revision, *FileSystemAttrs, error) {
+	if link == nil {
+		return nil, nil, ErrLinkMustNotBeNil
+	}
+
+	revisions, err := protonDrive.c.ListRevisions(ctx, protonDrive.MainShare.ShareID, link.LinkID)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	nodeKR, err := protonDrive.getLinkKR(ctx, link)
+	for i := range revisions {
+		if revisions[i].ID != revisionID {
+			continue
+		}
+
+		if revisions[i].State != proton.RevisionStateActive && revisions[i].State != proton.RevisionStateObsolete {
+			return nil, nil, ErrRevisionMustBeActiveOrObsolete
+		}
+
+		return protonDrive.getRevisionWithAttrs(ctx, link, &revisions[i])
+	}
+
+	return nil, nil, ErrCantFindRevision
+}
+
+func (protonDrive *ProtonDrive) getRevisionWithAttrs(ctx context.Context, link *proton.Link, revisionMetadata *proton.RevisionMetadata) (*proton.Revision, *FileSystemAttrs, error) {
+	revision, err := protonDrive.c.GetRevisionAllBlocks(ctx, protonDrive.MainShare.ShareID, link.LinkID, revisionMetadata.ID)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	signatureVerificationKR, err := protonDrive.getSignatureVerificationKeyring([]string{link.FileProperties.ActiveRevision.SignatureEmail})
+	nodeKR, err := protonDrive.getLinkKR(ctx, link)
 	if err != nil {
 		return nil, nil, err
 	}
-	revisionXAttrCommon, err := revision.GetDecXAttrString(signatureVerificationKR, nodeKR)
+
+	// each revision is signed by the address which uploaded it
+	signatureVerificationKR, err := protonDrive.getSignatureVerificationKeyring([]string{revisionMetadata.SignatureEmail})
 	if err != nil {
 		return nil, nil, err
 	}
-
-	modificationTime, err := iso8601.ParseString(revisionXAttrCommon.ModificationTime)
+	revisionXAttrCommon, err := decryptRevisionXAttr(signatureVerificationKR, nodeKR, revision.XAttr)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	var sha1Hash string
-	if val, ok := revisionXAttrCommon.Digests["SHA1"]; ok {
-		sha1Hash = val
-	} else {
-		sha1Hash = ""
+	if revisionXAttrCommon == nil {
+		return &revision, nil, nil
 	}
 
-	return &revision, &FileSystemAttrs{
-		ModificationTime: modificationTime,
-		Size:             revisionXAttrCommon.Size,
-		BlockSizes:       revisionXAttrCommon.BlockSizes,
-		Digests:          sha1Hash,
-	}, nil
+	fileSystemAttrs, err := newFileSystemAttrs(revisionXAttrCommon)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &revision, fileSystemAttrs, nil
 }
@@ -3,77 +3,497 @@ package proton_api_bridge
 import (
 	"bytes"
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"hash"
 	"io"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/ProtonMail/gopenpgp/v2/crypto"
 	"github.com/ProtonMail/go-proton-api"
+	"golang.org/x/sync/semaphore"
 )
 
 type FileDownloadReader struct {
 	protonDrive *ProtonDrive
 	ctx         context.Context
+	cancel      context.CancelFunc
+	closed      atomic.Bool
 
 	link         *proton.Link
 	data         *bytes.Buffer
+	dataPooled   bool // data comes from blockBufferPool, and can be returned once consumed
+	dataReserved int  // blocks of the memory budget held by data
 	nodeKR       *crypto.KeyRing
 	sessionKey   *crypto.SessionKey
 	revision     *proton.Revision
 	nextRevision int
+	endBlock     int // blocks from endBlock onwards are never downloaded
+
+	// read-ahead mode, enabled when readAhead > 0
+	readAhead    int
+	prefetched   []*prefetchedBlock // in block order, starting from nextRevision, each holding a block of the memory budget
+	nextPrefetch int
 
 	isEOF bool
 
-	// TODO: integrity check if the entire file is read
+	// random access, only available when the block sizes are known
+	position           int64
+	skipBytes          int64   // to discard from the start of the next block loaded by Read, after a Seek
+	blockOffsets       []int64 // blockOffsets[i] is the plaintext offset where block i starts, the last entry is the file size
+	recentBlocks       []*decryptedBlock // the ones with memoryReserved hold a block of the memory budget
+	recentBlocksLocker sync.Mutex
+
+	// ranged download, -1 = read until the end of the file
+	rangeEnd int64
+
+	// integrity check if the entire file is read from the start, nil once the check is no longer possible or done
+	fileSystemAttrs *FileSystemAttrs
+	sha1Digests     hash.Hash
+
+	progress ProgressReporter
+}
+
+var (
+	_ io.ReadSeekCloser = (*FileDownloadReader)(nil)
+	_ io.ReaderAt       = (*FileDownloadReader)(nil)
+)
+
+type decryptedBlock struct {
+	index          int
+	data           []byte
+	memoryReserved bool
+}
+
+type prefetchedBlock struct {
+	data *bytes.Buffer
+	err  error
+	done chan struct{}
 }
 
 func (r *FileDownloadReader) Read(p []byte) (int, error) {
+	if r.closed.Load() {
+		return 0, ErrDownloadReaderClosed
+	}
+	if r.rangeEnd >= 0 {
+		if r.position >= r.rangeEnd {
+			return 0, io.EOF
+		}
+		if int64(len(p)) > r.rangeEnd-r.position {
+			p = p[:r.rangeEnd-r.position]
+		}
+	}
+
 	if r.data.Len() == 0 {
-		// TODO: do we have memory sharing bug?
 		// to avoid sharing the underlying buffer array across re-population
-		r.data = bytes.NewBuffer(nil)
+		r.releaseData()
 
 		// we download and decrypt more content
 		err := r.populateBufferOnRead()
 		if err != nil {
+			// the content might be partially written before the verification failed
+			r.data.Reset()
 			return 0, err
 		}
 
 		if r.isEOF {
-			// if the file has been downloaded entirely, we return EOF
+			// if the file has been downloaded entirely, we verify it and return EOF
+			if err := r.verifyIntegrity(); err != nil {
+				return 0, err
+			}
 			return 0, io.EOF
 		}
+
+		// Seek might have landed in the middle of the block, which checkBlockSize made sure is there
+		r.data.Next(int(r.skipBytes))
+		r.skipBytes = 0
+	}
+
+	n, err := r.data.Read(p)
+	r.position += int64(n)
+	if r.sha1Digests != nil {
+		r.sha1Digests.Write(p[:n])
+	}
+	return n, err
+}
+
+// verifyIntegrity compares the size and the SHA1 of the content that has been read against the revision xattr
+func (r *FileDownloadReader) verifyIntegrity() error {
+	if r.sha1Digests == nil {
+		return nil
+	}
+	defer func() {
+		r.sha1Digests = nil
+	}()
+
+	return verifyFileSystemAttrs(r.fileSystemAttrs, r.position, r.sha1Digests)
+}
+
+func verifyFileSystemAttrs(fileSystemAttrs *FileSystemAttrs, size int64, sha1Digests hash.Hash) error {
+	// the uploader might not have recorded the size, i.e. it's 0, which an empty file passes anyway
+	if fileSystemAttrs.Size != 0 && size != fileSystemAttrs.Size {
+		return &FileIntegrityError{
+			Field:    "Size",
+			Expected: strconv.FormatInt(fileSystemAttrs.Size, 10),
+			Actual:   strconv.FormatInt(size, 10),
+		}
+	}
+
+	if fileSystemAttrs.Digests == "" {
+		// the uploader didn't record a digest
+		return nil
+	}
+	sha1String := hex.EncodeToString(sha1Digests.Sum(nil))
+	if sha1String != strings.ToLower(fileSystemAttrs.Digests) {
+		return &FileIntegrityError{
+			Field:    "SHA1",
+			Expected: strings.ToLower(fileSystemAttrs.Digests),
+			Actual:   sha1String,
+		}
+	}
+
+	return nil
+}
+
+// Seek moves the position of the next Read. Only the block containing the new position is downloaded.
+func (r *FileDownloadReader) Seek(offset int64, whence int) (int64, error) {
+	if r.closed.Load() {
+		return 0, ErrDownloadReaderClosed
+	}
+	if r.blockOffsets == nil {
+		return 0, ErrRandomAccessWithoutBlockSizes
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.position
+	case io.SeekEnd:
+		offset += r.size()
+	default:
+		return 0, ErrInvalidSeekWhence
+	}
+	if offset < 0 {
+		return 0, ErrNegativeSeekOffset
+	}
+	if offset == r.position {
+		return offset, nil
+	}
+
+	// the whole-file digest can't be computed once we skip around
+	r.sha1Digests = nil
+
+	if offset > r.position && offset-r.position <= int64(r.data.Len()) {
+		// still in the buffer, the blocks after it are still needed too
+		r.data.Next(int(offset - r.position))
+		r.position = offset
+		return offset, nil
+	}
+
+	// blocks that are being prefetched for the old position are dropped
+	r.dropPrefetched()
+	r.nextPrefetch = 0
+	r.isEOF = false
+	r.releaseData()
+	r.data = bytes.NewBuffer(nil)
+	r.position = offset
+
+	// the block is only downloaded by the next Read, as the caller might seek again before that
+	i, blockOffset := r.locateBlock(offset)
+	if i >= r.endBlock {
+		i, blockOffset = r.endBlock, 0
+	}
+	r.nextRevision = i
+	r.skipBytes = blockOffset
+
+	return offset, nil
+}
+
+// ReadAt reads len(p) bytes starting at offset off, without affecting the position of Read and Seek.
+// It is safe to be called concurrently, including with Close, which makes the pending calls fail.
+func (r *FileDownloadReader) ReadAt(p []byte, off int64) (int, error) {
+	if r.closed.Load() {
+		return 0, ErrDownloadReaderClosed
+	}
+	if r.blockOffsets == nil {
+		return 0, ErrRandomAccessWithoutBlockSizes
+	}
+	if off < 0 {
+		return 0, ErrNegativeSeekOffset
+	}
+
+	n := 0
+	for n < len(p) {
+		i, blockOffset := r.locateBlock(off + int64(n))
+		if i >= len(r.revision.Blocks) {
+			break
+		}
+
+		// the size of data has been checked, so blockOffset is within it
+		data, err := r.getDecryptedBlock(i)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data[blockOffset:])
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// limitToRange restricts the reader to [offset, offset+length), so only the overlapping blocks will be downloaded.
+// It returns the number of bytes available in the range.
+func (r *FileDownloadReader) limitToRange(offset, length int64) (int64, error) {
+	if r.blockOffsets == nil {
+		return r.limitToRangeSequentially(offset, length)
+	}
+	if offset < 0 || length < 0 || offset > r.size() {
+		return 0, ErrInvalidDownloadRange
+	}
+	if offset+length > r.size() {
+		length = r.size() - offset
+	}
+
+	r.rangeEnd = offset + length
+	endBlock, blockOffset := r.locateBlock(r.rangeEnd)
+	if blockOffset > 0 {
+		// the range ends in the middle of a block
+		endBlock++
+	}
+	r.endBlock = endBlock
+
+	_, err := r.Seek(offset, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	return length, nil
+}
+
+// limitToRangeSequentially is the fallback of limitToRange when the block sizes are unknown,
+// the content before offset is downloaded and discarded, and the length can only be clamped if the xattr has the file size
+func (r *FileDownloadReader) limitToRangeSequentially(offset, length int64) (int64, error) {
+	if offset < 0 || length < 0 {
+		return 0, ErrInvalidDownloadRange
+	}
+	if r.fileSystemAttrs != nil && r.fileSystemAttrs.Size > 0 {
+		if offset > r.fileSystemAttrs.Size {
+			return 0, ErrInvalidDownloadRange
+		}
+		if offset+length > r.fileSystemAttrs.Size {
+			length = r.fileSystemAttrs.Size - offset
+		}
+	}
+
+	// the range isn't set yet, so it doesn't cut the skipping short
+	err := r.seekFromStart(offset)
+	if err != nil {
+		return 0, err
+	}
+	r.rangeEnd = offset + length
+
+	return length, nil
+}
+
+func (r *FileDownloadReader) size() int64 {
+	return r.blockOffsets[len(r.blockOffsets)-1]
+}
+
+// locateBlock maps a plaintext offset to the block index and the offset within that block
+func (r *FileDownloadReader) locateBlock(offset int64) (int, int64) {
+	if offset >= r.size() {
+		return len(r.revision.Blocks), 0
+	}
+
+	i := sort.Search(len(r.revision.Blocks), func(i int) bool {
+		return r.blockOffsets[i+1] > offset
+	})
+	return i, offset - r.blockOffsets[i]
+}
+
+// checkBlockSize rejects a decrypted block i whose size doesn't match the xattr, as the offsets of Seek and ReadAt rely on it
+func (r *FileDownloadReader) checkBlockSize(i int, size int) error {
+	if r.blockOffsets == nil {
+		return nil
+	}
+
+	blockSize := r.blockOffsets[i+1] - r.blockOffsets[i]
+	if int64(size) != blockSize {
+		return &FileIntegrityError{
+			Field:    "BlockSizes",
+			Expected: strconv.FormatInt(blockSize, 10),
+			Actual:   strconv.Itoa(size),
+		}
+	}
+
+	return nil
+}
+
+// getDecryptedBlock returns the plaintext of block i, keeping the most recently used ones around.
+// The returned slice is shared and must not be modified.
+func (r *FileDownloadReader) getDecryptedBlock(i int) ([]byte, error) {
+	if data := r.getRecentBlock(i); data != nil {
+		return data, nil
+	}
+
+	// never waits for the memory budget, as the caller might be holding some of it with Read,
+	// the least recently used block makes room instead, and the block isn't kept if there's none
+	memoryReserved := r.protonDrive.downloadMemoryBudget.tryReserveBlock() || r.evictRecentBlock()
+
+	buffer := bytes.NewBuffer(nil)
+	err := r.protonDrive.downloadBlock(r.ctx, r.link, r.nodeKR, r.sessionKey, &r.revision.Blocks[i], buffer, r.progress)
+	if err == nil {
+		err = r.checkBlockSize(i, buffer.Len())
+	}
+	if err != nil {
+		if memoryReserved {
+			r.protonDrive.downloadMemoryBudget.releaseBlock()
+		}
+		return nil, err
+	}
+	if !memoryReserved {
+		return buffer.Bytes(), nil
+	}
+
+	r.recentBlocksLocker.Lock()
+	defer r.recentBlocksLocker.Unlock()
+	if r.closed.Load() {
+		// Close has already released the others
+		r.protonDrive.downloadMemoryBudget.releaseBlock()
+		return buffer.Bytes(), nil
+	}
+	r.recentBlocks = append([]*decryptedBlock{{index: i, data: buffer.Bytes(), memoryReserved: true}}, r.recentBlocks...)
+	for len(r.recentBlocks) > DOWNLOAD_CACHED_BLOCK_COUNT {
+		r.releaseRecentBlock(len(r.recentBlocks) - 1)
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// evictRecentBlock drops the least recently used block, and returns whether its memory budget can be taken over
+func (r *FileDownloadReader) evictRecentBlock() bool {
+	r.recentBlocksLocker.Lock()
+	defer r.recentBlocksLocker.Unlock()
+
+	if len(r.recentBlocks) == 0 {
+		return false
+	}
+	memoryReserved := r.recentBlocks[len(r.recentBlocks)-1].memoryReserved
+	r.recentBlocks = r.recentBlocks[:len(r.recentBlocks)-1]
+	return memoryReserved
+}
+
+// releaseRecentBlock drops the block at position j of recentBlocks with its memory budget, recentBlocksLocker must be held
+func (r *FileDownloadReader) releaseRecentBlock(j int) {
+	if r.recentBlocks[j].memoryReserved {
+		r.protonDrive.downloadMemoryBudget.releaseBlock()
+	}
+	r.recentBlocks = append(r.recentBlocks[:j], r.recentBlocks[j+1:]...)
+}
+
+func (r *FileDownloadReader) getRecentBlock(i int) []byte {
+	r.recentBlocksLocker.Lock()
+	defer r.recentBlocksLocker.Unlock()
+
+	for j, block := range r.recentBlocks {
+		if block.index == i {
+			// move to the front
+			copy(r.recentBlocks[1:j+1], r.recentBlocks[:j])
+			r.recentBlocks[0] = block
+			return block.data
+		}
 	}
+	return nil
+}
+
+// releaseData hands the current buffer back to the pool if we own it, together with its memory budget
+func (r *FileDownloadReader) releaseData() {
+	if r.dataPooled {
+		putBlockBuffer(r.data)
+		r.data = bytes.NewBuffer(nil)
+	}
+	r.dataPooled = false
 
-	return r.data.Read(p)
+	for ; r.dataReserved > 0; r.dataReserved-- {
+		r.protonDrive.downloadMemoryBudget.releaseBlock()
+	}
+}
+
+// dropPrefetched releases the prefetched blocks once their download is over, as the buffer is still being written to until then
+func (r *FileDownloadReader) dropPrefetched() {
+	for _, block := range r.prefetched {
+		go func(protonDrive *ProtonDrive, block *prefetchedBlock) {
+			<-block.done
+			putBlockBuffer(block.data)
+			protonDrive.downloadMemoryBudget.releaseBlock()
+		}(r.protonDrive, block)
+	}
+	r.prefetched = nil
 }
 
 func (r *FileDownloadReader) Close() error {
-	r.protonDrive = nil
+	r.closed.Store(true)
+
+	// stop all in-flight prefetching
+	r.cancel()
+	r.dropPrefetched()
+	r.releaseData()
+	r.data = bytes.NewBuffer(nil)
+
+	r.recentBlocksLocker.Lock()
+	defer r.recentBlocksLocker.Unlock()
+	for len(r.recentBlocks) > 0 {
+		r.releaseRecentBlock(len(r.recentBlocks) - 1)
+	}
 
 	return nil
 }
 
 func (reader *FileDownloadReader) populateBufferOnRead() error {
-	if len(reader.revision.Blocks) == 0 || len(reader.revision.Blocks) == reader.nextRevision {
+	if len(reader.revision.Blocks) == 0 || reader.nextRevision >= reader.endBlock {
 		reader.isEOF = true
 		return nil
 	}
 
+	if reader.readAhead > 0 {
+		return reader.populateBufferFromPrefetch()
+	}
+
+	reader.data = getBlockBuffer()
+	reader.dataPooled = true
+
 	offset := reader.nextRevision
-	for i := offset; i-offset < DOWNLOAD_BATCH_BLOCK_SIZE && i < len(reader.revision.Blocks); i++ {
-		// TODO: parallel download
-		blockReader, err := reader.protonDrive.c.GetBlock(reader.ctx, reader.revision.Blocks[i].BareURL, reader.revision.Blocks[i].Token)
-		if err != nil {
-			return err
+	for i := offset; i-offset < DOWNLOAD_BATCH_BLOCK_SIZE && i < reader.endBlock; i++ {
+		// only wait for the memory budget while holding none of it, the batch is cut short otherwise
+		if reader.dataReserved == 0 {
+			if err := reader.protonDrive.downloadMemoryBudget.reserveBlock(reader.ctx); err != nil {
+				return err
+			}
+		} else if !reader.protonDrive.downloadMemoryBudget.tryReserveBlock() {
+			break
+		}
+		reader.dataReserved++
+
+		if data := reader.getRecentBlock(i); data != nil {
+			// already decrypted for Seek or ReadAt
+			reader.data.Write(data)
+			reader.nextRevision = i + 1
+			continue
 		}
-		defer blockReader.Close()
 
-		signatureVerificationKR, err := reader.protonDrive.getSignatureVerificationKeyring([]string{reader.link.SignatureEmail}, reader.nodeKR)
+		dataLen := reader.data.Len()
+		err := reader.protonDrive.downloadBlock(reader.ctx, reader.link, reader.nodeKR, reader.sessionKey, &reader.revision.Blocks[i], reader.data, reader.progress)
 		if err != nil {
 			return err
 		}
-		err = decryptBlockIntoBuffer(reader.sessionKey, signatureVerificationKR, reader.nodeKR, reader.revision.Blocks[i].Hash, reader.revision.Blocks[i].EncSignature, reader.data, blockReader)
-		if err != nil {
+		if err := reader.checkBlockSize(i, reader.data.Len()-dataLen); err != nil {
 			return err
 		}
 
@@ -83,7 +503,163 @@ func (reader *FileDownloadReader) populateBufferOnRead() error {
 	return nil
 }
 
+// schedulePrefetch keeps up to readAhead blocks, starting from nextRevision, being fetched and decrypted in the background
+// with blocking, it waits for the memory budget of the first block if nothing is prefetched, the read-ahead is limited to what's left of the budget otherwise
+func (reader *FileDownloadReader) schedulePrefetch(blocking bool) error {
+	if reader.nextPrefetch < reader.nextRevision {
+		reader.nextPrefetch = reader.nextRevision
+	}
+
+	for len(reader.prefetched) < reader.readAhead && reader.nextPrefetch < reader.endBlock {
+		if blocking && len(reader.prefetched) == 0 {
+			if err := reader.protonDrive.downloadMemoryBudget.reserveBlock(reader.ctx); err != nil {
+				return err
+			}
+		} else if !reader.protonDrive.downloadMemoryBudget.tryReserveBlock() {
+			break
+		}
+
+		block := &prefetchedBlock{
+			data: getBlockBuffer(),
+			done: make(chan struct{}),
+		}
+		reader.prefetched = append(reader.prefetched, block)
+
+		// the reader might be closed while we are still downloading, so we hold on to what we need
+		go func(protonDrive *ProtonDrive, revisionBlock *proton.Block) {
+			defer close(block.done)
+
+			block.err = protonDrive.downloadBlock(reader.ctx, reader.link, reader.nodeKR, reader.sessionKey, revisionBlock, block.data, reader.progress)
+		}(reader.protonDrive, &reader.revision.Blocks[reader.nextPrefetch])
+
+		reader.nextPrefetch++
+	}
+
+	return nil
+}
+
+func (reader *FileDownloadReader) populateBufferFromPrefetch() error {
+	if err := reader.schedulePrefetch(true); err != nil {
+		return err
+	}
+
+	block := reader.prefetched[0]
+	select {
+	case <-block.done:
+	case <-reader.ctx.Done():
+		return reader.ctx.Err()
+	}
+	if block.err != nil {
+		return block.err
+	}
+	if err := reader.checkBlockSize(reader.nextRevision, block.data.Len()); err != nil {
+		return err
+	}
+
+	reader.prefetched = reader.prefetched[1:]
+	reader.releaseData()
+	reader.data = block.data
+	reader.dataPooled = true
+	reader.dataReserved = 1
+	reader.nextRevision++
+
+	// refill the window while the caller consumes the current block
+	return reader.schedulePrefetch(false)
+}
+
+// downloadBlock streams the block from the block cache or the network, through the decryption, into buffer
+// the block is reported to progress once it's verified, so a block which fails halfway is never counted
+func (protonDrive *ProtonDrive) downloadBlock(ctx context.Context, link *proton.Link, nodeKR *crypto.KeyRing, sessionKey *crypto.SessionKey, block *proton.Block, buffer io.Writer, progress ProgressReporter) error {
+	signatureVerificationKR, err := protonDrive.getSignatureVerificationKeyring([]string{link.SignatureEmail}, nodeKR)
+	if err != nil {
+		return err
+	}
+
+	cryptoSemaphore := &cryptoSemaphoreHolder{ctx: ctx, semaphore: protonDrive.blockCryptoSemaphore}
+	defer cryptoSemaphore.release()
+
+	var blockReader io.Reader
+	var blockCacheWriter *blockCacheWriter
+	if data, ok := protonDrive.blockCache.get(block.Hash); ok {
+		blockReader = bytes.NewReader(data)
+	} else {
+		blockReadCloser, err := protonDrive.api.GetBlock(ctx, block.BareURL, block.Token)
+		if err != nil {
+			return err
+		}
+		defer blockReadCloser.Close()
+		// the crypto semaphore is handed back while waiting for the network, so it doesn't limit the downloads in flight to the CPU count
+		blockReader = &cryptoSemaphoreYieldingReader{holder: cryptoSemaphore, r: blockReadCloser}
+
+		blockCacheWriter = protonDrive.blockCache.newWriter(block.Hash)
+		if blockCacheWriter != nil {
+			defer blockCacheWriter.abort()
+			blockReader = io.TeeReader(blockReader, blockCacheWriter)
+		}
+	}
+
+	if err := cryptoSemaphore.acquire(); err != nil {
+		return err
+	}
+	countingBlockReader := &countingReader{r: blockReader}
+	countingBuffer := &countingWriter{w: buffer}
+	err = decryptBlockIntoBuffer(sessionKey, signatureVerificationKR, nodeKR, block.Hash, block.EncSignature, countingBuffer, countingBlockReader)
+	if err != nil {
+		return err
+	}
+	progress.BlockFetched(block.Index, countingBlockReader.n)
+	progress.BlockDecrypted(block.Index, countingBuffer.n)
+
+	if blockCacheWriter != nil {
+		// the hash is verified, so the block can be served from the cache from now on
+		blockCacheWriter.commit()
+	}
+
+	return nil
+}
+
+// cryptoSemaphoreHolder keeps track of whether a download holds the crypto semaphore, as it's given back and taken again during the download
+type cryptoSemaphoreHolder struct {
+	ctx       context.Context
+	semaphore *semaphore.Weighted
+	held      bool
+}
+
+func (holder *cryptoSemaphoreHolder) acquire() error {
+	if err := holder.semaphore.Acquire(holder.ctx, 1); err != nil {
+		return err
+	}
+	holder.held = true
+	return nil
+}
+
+func (holder *cryptoSemaphoreHolder) release() {
+	if holder.held {
+		holder.semaphore.Release(1)
+		holder.held = false
+	}
+}
+
+// cryptoSemaphoreYieldingReader releases the crypto semaphore for the duration of each Read of the network
+type cryptoSemaphoreYieldingReader struct {
+	holder *cryptoSemaphoreHolder
+	r      io.Reader
+}
+
+func (r *cryptoSemaphoreYieldingReader) Read(p []byte) (int, error) {
+	r.holder.release()
+	n, err := r.r.Read(p)
+	if acquireErr := r.holder.acquire(); acquireErr != nil {
+		return n, acquireErr
+	}
+	return n, err
+}
+
 func (protonDrive *ProtonDrive) DownloadFileByID(ctx context.Context, linkID string, offset int64) (io.ReadCloser, int64, *FileSystemAttrs, error) {
+	return protonDrive.DownloadFileByIDWithProgress(ctx, linkID, offset, nil)
+}
+
+func (protonDrive *ProtonDrive) DownloadFileByIDWithProgress(ctx context.Context, linkID string, offset int64, progress ProgressReporter) (io.ReadCloser, int64, *FileSystemAttrs, error) {
 	/* It's like event system, we need to get the latest information before creating the move request! */
 	protonDrive.removeLinkIDFromCache(linkID, false)
 
@@ -92,41 +668,177 @@ func (protonDrive *ProtonDrive) DownloadFileByID(ctx context.Context, linkID str
 		return nil, 0, nil, err
 	}
 
-	return protonDrive.DownloadFile(ctx, link, offset)
+	return protonDrive.DownloadFileWithProgress(ctx, link, offset, progress)
 }
 
+// DownloadFile returns a *FileDownloadReader, so the caller can type assert it to io.Seeker or io.ReaderAt,
+// which only work when the block sizes of the file are known.
 func (protonDrive *ProtonDrive) DownloadFile(ctx context.Context, link *proton.Link, offset int64) (io.ReadCloser, int64, *FileSystemAttrs, error) {
+	return protonDrive.DownloadFileWithProgress(ctx, link, offset, nil)
+}
+
+// DownloadFileWithProgress is DownloadFile reporting the blocks fetched and decrypted to progress
+func (protonDrive *ProtonDrive) DownloadFileWithProgress(ctx context.Context, link *proton.Link, offset int64, progress ProgressReporter) (io.ReadCloser, int64, *FileSystemAttrs, error) {
 	if link.Type != proton.LinkTypeFile {
 		return nil, 0, nil, ErrLinkTypeMustToBeFileType
 	}
 
-	parentNodeKR, err := protonDrive.getLinkKRByID(ctx, link.ParentLinkID)
+	revision, fileSystemAttrs, err := protonDrive.GetActiveRevisionWithAttrs(ctx, link)
 	if err != nil {
 		return nil, 0, nil, err
 	}
 
-	signatureVerificationKR, err := protonDrive.getSignatureVerificationKeyring([]string{link.SignatureEmail})
+	reader, err := protonDrive.newFileDownloadReader(ctx, link, revision, fileSystemAttrs, progress)
 	if err != nil {
 		return nil, 0, nil, err
 	}
-	nodeKR, err := link.GetKeyRing(parentNodeKR, signatureVerificationKR)
+
+	err = reader.seekFromStart(offset)
 	if err != nil {
+		reader.Close()
 		return nil, 0, nil, err
 	}
 
-	sessionKey, err := link.GetSessionKey(nodeKR)
+	return reader, link.Size, fileSystemAttrs, nil
+}
+
+func (protonDrive *ProtonDrive) DownloadRevisionByID(ctx context.Context, linkID, revisionID string, offset int64, progress ProgressReporter) (io.ReadCloser, int64, *FileSystemAttrs, error) {
+	/* It's like event system, we need to get the latest information before creating the move request! */
+	protonDrive.removeLinkIDFromCache(linkID, false)
+
+	link, err := protonDrive.getLink(ctx, linkID)
 	if err != nil {
 		return nil, 0, nil, err
 	}
 
+	return protonDrive.DownloadRevision(ctx, link, revisionID, offset, progress)
+}
+
+// DownloadRevision reads an active or obsolete revision of the file, e.g. to recover from an accidental overwrite.
+// The returned size is the size of that revision.
+func (protonDrive *ProtonDrive) DownloadRevision(ctx context.Context, link *proton.Link, revisionID string, offset int64, progress ProgressReporter) (io.ReadCloser, int64, *FileSystemAttrs, error) {
+	if link.Type != proton.LinkTypeFile {
+		return nil, 0, nil, ErrLinkTypeMustToBeFileType
+	}
+
+	revision, fileSystemAttrs, err := protonDrive.GetRevisionWithAttrs(ctx, link, revisionID)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	reader, err := protonDrive.newFileDownloadReader(ctx, link, revision, fileSystemAttrs, progress)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	err = reader.seekFromStart(offset)
+	if err != nil {
+		reader.Close()
+		return nil, 0, nil, err
+	}
+
+	return reader, revision.Size, fileSystemAttrs, nil
+}
+
+func (protonDrive *ProtonDrive) DownloadRangeByID(ctx context.Context, linkID string, offset, length int64, progress ProgressReporter) (io.ReadCloser, int64, *FileSystemAttrs, error) {
+	/* It's like event system, we need to get the latest information before creating the move request! */
+	protonDrive.removeLinkIDFromCache(linkID, false)
+
+	link, err := protonDrive.getLink(ctx, linkID)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	return protonDrive.DownloadRange(ctx, link, offset, length, progress)
+}
+
+// DownloadRange only fetches the blocks overlapping [offset, offset+length).
+// The returned count is the exact number of bytes the reader will yield, which is less than length if the range goes past the end of the file.
+// If the xattr lacks the block sizes, the file is read from the start and the content before offset is discarded,
+// and if it lacks the file size too, the count is length, even past the end of the file.
+func (protonDrive *ProtonDrive) DownloadRange(ctx context.Context, link *proton.Link, offset, length int64, progress ProgressReporter) (io.ReadCloser, int64, *FileSystemAttrs, error) {
+	if link.Type != proton.LinkTypeFile {
+		return nil, 0, nil, ErrLinkTypeMustToBeFileType
+	}
+
 	revision, fileSystemAttrs, err := protonDrive.GetActiveRevisionWithAttrs(ctx, link)
 	if err != nil {
 		return nil, 0, nil, err
 	}
 
+	reader, err := protonDrive.newFileDownloadReader(ctx, link, revision, fileSystemAttrs, progress)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	length, err = reader.limitToRange(offset, length)
+	if err != nil {
+		reader.Close()
+		return nil, 0, nil, err
+	}
+
+	return reader, length, fileSystemAttrs, nil
+}
+
+// seekFromStart positions the reader at offset, falling back to reading and discarding the content if the block sizes are unknown
+func (reader *FileDownloadReader) seekFromStart(offset int64) error {
+	if offset == 0 {
+		return nil
+	}
+
+	if reader.blockOffsets != nil {
+		// download will start from the block containing the offset
+		_, err := reader.Seek(offset, io.SeekStart)
+		return err
+	}
+
+	log.Println("Performing inefficient seek as metadata of encrypted file is missing")
+	n, err := io.CopyN(io.Discard, reader, offset)
+	if err != nil {
+		return err
+	}
+	if int64(n) != offset {
+		return ErrSeekOffsetAfterSkippingBlocks
+	}
+
+	return nil
+}
+
+func (protonDrive *ProtonDrive) newFileDownloadReader(ctx context.Context, link *proton.Link, revision *proton.Revision, fileSystemAttrs *FileSystemAttrs, progress ProgressReporter) (*FileDownloadReader, error) {
+	parentNodeKR, err := protonDrive.getLinkKRByID(ctx, link.ParentLinkID)
+	if err != nil {
+		return nil, err
+	}
+
+	signatureVerificationKR, err := protonDrive.getSignatureVerificationKeyring([]string{link.SignatureEmail})
+	if err != nil {
+		return nil, err
+	}
+	nodeKR, err := link.GetKeyRing(parentNodeKR, signatureVerificationKR)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionKey, err := link.GetSessionKey(nodeKR)
+	if err != nil {
+		return nil, err
+	}
+
+	// reject missing, reordered, or tampered blocks before downloading anything
+	signatureVerificationKR, err = protonDrive.getSignatureVerificationKeyring([]string{revision.SignatureEmail})
+	if err != nil {
+		return nil, err
+	}
+	err = verifyManifestSignature(revision, signatureVerificationKR)
+	if err != nil {
+		return nil, err
+	}
+
+	readerCtx, cancel := context.WithCancel(ctx)
 	reader := &FileDownloadReader{
 		protonDrive: protonDrive,
-		ctx:         ctx,
+		ctx:         readerCtx,
+		cancel:      cancel,
 
 		link:         link,
 		data:         bytes.NewBuffer(nil),
@@ -134,48 +846,32 @@ func (protonDrive *ProtonDrive) DownloadFile(ctx context.Context, link *proton.L
 		sessionKey:   sessionKey,
 		revision:     revision,
 		nextRevision: 0,
+		endBlock:     len(revision.Blocks),
+
+		readAhead: protonDrive.Config.DownloadReadAheadBlockCount,
 
 		isEOF: false,
+
+		rangeEnd: -1,
+
+		fileSystemAttrs: fileSystemAttrs,
+
+		progress: progressReporterOrNop(progress),
 	}
 
-	useFallbackDownload := false
 	if fileSystemAttrs != nil {
-		// based on offset, infer the nextRevision (0-based)
-		if fileSystemAttrs.BlockSizes == nil {
-			useFallbackDownload = true
-		} else {
-			// infer nextRevision
-			totalBytes := int64(0)
-			for i := 0; i < len(fileSystemAttrs.BlockSizes); i++ {
-				prevTotalBytes := totalBytes
-				totalBytes += fileSystemAttrs.BlockSizes[i]
-				if offset <= totalBytes {
-					offset = offset - prevTotalBytes
-					reader.nextRevision = i
-					break
-				}
-			}
-
-			// download will start from the specified block
-			n, err := io.CopyN(io.Discard, reader, offset)
-			if err != nil {
-				return nil, 0, nil, err
-			}
-			if int64(n) != offset {
-				return nil, 0, nil, ErrSeekOffsetAfterSkippingBlocks
-			}
-		}
+		reader.sha1Digests = sha1.New()
 	}
 
-	if useFallbackDownload {
-		log.Println("Performing inefficient seek as metadata of encrypted file is missing")
-		n, err := io.CopyN(io.Discard, reader, offset)
-		if err != nil {
-			return nil, 0, nil, err
-		}
-		if int64(n) != offset {
-			return nil, 0, nil, ErrSeekOffsetAfterSkippingBlocks
+	if fileSystemAttrs != nil && fileSystemAttrs.BlockSizes != nil && len(fileSystemAttrs.BlockSizes) == len(revision.Blocks) {
+		reader.blockOffsets = make([]int64, 0, len(fileSystemAttrs.BlockSizes)+1)
+		totalBytes := int64(0)
+		for i := range fileSystemAttrs.BlockSizes {
+			reader.blockOffsets = append(reader.blockOffsets, totalBytes)
+			totalBytes += fileSystemAttrs.BlockSizes[i]
 		}
+		reader.blockOffsets = append(reader.blockOffsets, totalBytes)
 	}
-	return reader, link.Size, fileSystemAttrs, nil
+
+	return reader, nil
 }
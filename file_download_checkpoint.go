@@ -0,0 +1,213 @@
+package proton_api_bridge
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+
+	"github.com/ProtonMail/go-proton-api"
+)
+
+const (
+	DOWNLOAD_PARTIAL_FILE_SUFFIX    = ".partial"
+	DOWNLOAD_CHECKPOINT_FILE_SUFFIX = ".partial.checkpoint"
+)
+
+type downloadCheckpoint struct {
+	LinkID         string
+	RevisionID     string
+	VerifiedBlocks []int // block indexes, as given by the server, in the order they are written
+	VerifiedBytes  int64 // size of the content written for the verified blocks
+}
+
+func readDownloadCheckpoint(checkpointPath string) (*downloadCheckpoint, error) {
+	data, err := os.ReadFile(checkpointPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var checkpoint downloadCheckpoint
+	err = json.Unmarshal(data, &checkpoint)
+	if err != nil {
+		// a corrupted checkpoint is as good as no checkpoint
+		return nil, nil
+	}
+
+	return &checkpoint, nil
+}
+
+func writeDownloadCheckpoint(checkpointPath string, checkpoint *downloadCheckpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	// write and rename, so a crash never leaves a half-written checkpoint behind
+	err = os.WriteFile(checkpointPath+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(checkpointPath+".tmp", checkpointPath)
+}
+
+func (protonDrive *ProtonDrive) DownloadToFileByID(ctx context.Context, linkID string, path string, progress ProgressReporter) (*FileSystemAttrs, error) {
+	/* It's like event system, we need to get the latest information before creating the move request! */
+	protonDrive.removeLinkIDFromCache(linkID, false)
+
+	link, err := protonDrive.getLink(ctx, linkID)
+	if err != nil {
+		return nil, err
+	}
+
+	return protonDrive.DownloadToFile(ctx, link, path, progress)
+}
+
+/*
+DownloadToFile writes into a temporary file next to the destination, and keeps a sidecar checkpoint
+recording which blocks have been downloaded and verified so far.
+
+If the download is interrupted, calling DownloadToFile again picks up from the first unverified block,
+as long as the active revision of the file stays the same. Otherwise, the download starts over.
+
+progress is optional. The blocks verified by a previous attempt are not reported again.
+*/
+func (protonDrive *ProtonDrive) DownloadToFile(ctx context.Context, link *proton.Link, path string, progress ProgressReporter) (*FileSystemAttrs, error) {
+	if link.Type != proton.LinkTypeFile {
+		return nil, ErrLinkTypeMustToBeFileType
+	}
+
+	revision, fileSystemAttrs, err := protonDrive.GetActiveRevisionWithAttrs(ctx, link)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := protonDrive.newFileDownloadReader(ctx, link, revision, fileSystemAttrs, progress)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	partialPath := path + DOWNLOAD_PARTIAL_FILE_SUFFIX
+	checkpointPath := path + DOWNLOAD_CHECKPOINT_FILE_SUFFIX
+
+	checkpoint, err := readDownloadCheckpoint(checkpointPath)
+	if err != nil {
+		return nil, err
+	}
+	if checkpoint == nil || checkpoint.LinkID != link.LinkID || checkpoint.RevisionID != revision.ID {
+		// the file has changed since the last attempt, or there was no previous attempt
+		checkpoint = &downloadCheckpoint{
+			LinkID:         link.LinkID,
+			RevisionID:     revision.ID,
+			VerifiedBlocks: make([]int, 0),
+			VerifiedBytes:  0,
+		}
+	}
+
+	// the blocks are downloaded in order, so the verified blocks must be the leading ones
+	nextBlock := 0
+	for nextBlock < len(checkpoint.VerifiedBlocks) && nextBlock < len(revision.Blocks) && checkpoint.VerifiedBlocks[nextBlock] == revision.Blocks[nextBlock].Index {
+		nextBlock++
+	}
+	file, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	// closed before the rename, as an open file can't be renamed on Windows
+	closeFile := sync.OnceValue(file.Close)
+	defer closeFile()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// the partial file might also have been truncated or replaced since the last attempt
+	if nextBlock != len(checkpoint.VerifiedBlocks) || fileInfo.Size() < checkpoint.VerifiedBytes {
+		checkpoint.VerifiedBlocks = make([]int, 0)
+		checkpoint.VerifiedBytes = 0
+		nextBlock = 0
+	}
+
+	// anything after the last verified block was written by an interrupted attempt
+	err = file.Truncate(checkpoint.VerifiedBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// the digest covers the whole file, so we need to account for the content we already have
+	sha1Digests := sha1.New()
+	_, err = io.Copy(sha1Digests, io.NewSectionReader(file, 0, checkpoint.VerifiedBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = file.Seek(checkpoint.VerifiedBytes, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	err = protonDrive.downloadMemoryBudget.reserveBlock(reader.ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer protonDrive.downloadMemoryBudget.releaseBlock()
+
+	buffer := getBlockBuffer()
+	defer putBlockBuffer(buffer)
+	for i := nextBlock; i < len(revision.Blocks); i++ {
+		buffer.Reset()
+		err = protonDrive.downloadBlock(reader.ctx, link, reader.nodeKR, reader.sessionKey, &revision.Blocks[i], buffer, reader.progress)
+		if err != nil {
+			return nil, err
+		}
+
+		sha1Digests.Write(buffer.Bytes())
+		n, err := buffer.WriteTo(file)
+		if err != nil {
+			return nil, err
+		}
+
+		// make sure the content is on disk before the checkpoint claims so
+		err = file.Sync()
+		if err != nil {
+			return nil, err
+		}
+
+		checkpoint.VerifiedBlocks = append(checkpoint.VerifiedBlocks, revision.Blocks[i].Index)
+		checkpoint.VerifiedBytes += n
+		err = writeDownloadCheckpoint(checkpointPath, checkpoint)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if fileSystemAttrs != nil {
+		err = verifyFileSystemAttrs(fileSystemAttrs, checkpoint.VerifiedBytes, sha1Digests)
+		if err != nil {
+			// the content can't be trusted, so the next attempt should start over
+			os.Remove(checkpointPath)
+			return nil, err
+		}
+	}
+
+	err = closeFile()
+	if err != nil {
+		return nil, err
+	}
+	err = os.Rename(partialPath, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return fileSystemAttrs, os.Remove(checkpointPath)
+}
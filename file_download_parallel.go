@@ -0,0 +1,127 @@
+package proton_api_bridge
+
+import (
+	"context"
+	"io"
+
+	"github.com/ProtonMail/go-proton-api"
+)
+
+func (protonDrive *ProtonDrive) DownloadToByID(ctx context.Context, linkID string, w io.WriterAt, progress ProgressReporter) (*FileSystemAttrs, error) {
+	/* It's like event system, we need to get the latest information before creating the move request! */
+	protonDrive.removeLinkIDFromCache(linkID, false)
+
+	link, err := protonDrive.getLink(ctx, linkID)
+	if err != nil {
+		return nil, err
+	}
+
+	return protonDrive.DownloadTo(ctx, link, w, progress)
+}
+
+/*
+DownloadTo fetches, verifies, and writes the blocks concurrently and in any order, with ConcurrentBlockDownloadCount workers.
+Each block is verified against its hash and signature, but the whole-file SHA1 isn't checked as the content isn't read in order.
+
+If the block sizes are missing from the metadata, the offsets of the blocks are unknown until the previous ones are decrypted,
+so the file is read in order instead, like DownloadFile does, and the whole-file SHA1 is checked then.
+
+progress is optional, the blocks are reported as they complete, in any order.
+*/
+func (protonDrive *ProtonDrive) DownloadTo(ctx context.Context, link *proton.Link, w io.WriterAt, progress ProgressReporter) (*FileSystemAttrs, error) {
+	if link.Type != proton.LinkTypeFile {
+		return nil, ErrLinkTypeMustToBeFileType
+	}
+
+	revision, fileSystemAttrs, err := protonDrive.GetActiveRevisionWithAttrs(ctx, link)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := protonDrive.newFileDownloadReader(ctx, link, revision, fileSystemAttrs, progress)
+	if err != nil {
+		return nil, err
+	}
+	// also stops all the other blocks once one of them fails
+	defer reader.Close()
+
+	err = protonDrive.downloadBlocksTo(reader, w)
+	if err != nil {
+		return nil, err
+	}
+
+	return fileSystemAttrs, nil
+}
+
+func (protonDrive *ProtonDrive) downloadBlocksTo(reader *FileDownloadReader, w io.WriterAt) error {
+	if reader.blockOffsets == nil {
+		_, err := io.Copy(io.NewOffsetWriter(w, 0), reader)
+		return err
+	}
+
+	blocks := reader.revision.Blocks[:reader.endBlock]
+	blockIndices := make(chan int)
+	go func() {
+		defer close(blockIndices)
+		for i := range blocks {
+			select {
+			case blockIndices <- i:
+			case <-reader.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	downloadBlockTo := func(i int) error {
+		if err := protonDrive.blockDownloadSemaphore.Acquire(reader.ctx, 1); err != nil {
+			return err
+		}
+		defer protonDrive.blockDownloadSemaphore.Release(1)
+
+		// each block is released before the next one is reserved, so it's safe to wait
+		if err := protonDrive.downloadMemoryBudget.reserveBlock(reader.ctx); err != nil {
+			return err
+		}
+		defer protonDrive.downloadMemoryBudget.releaseBlock()
+
+		buffer := getBlockBuffer()
+		defer putBlockBuffer(buffer)
+
+		err := protonDrive.downloadBlock(reader.ctx, reader.link, reader.nodeKR, reader.sessionKey, &blocks[i], buffer, reader.progress)
+		if err != nil {
+			return err
+		}
+
+		if err := reader.checkBlockSize(i, buffer.Len()); err != nil {
+			return err
+		}
+
+		_, err = w.WriteAt(buffer.Bytes(), reader.blockOffsets[i])
+		return err
+	}
+
+	workers := min(max(protonDrive.Config.ConcurrentBlockDownloadCount, 1), len(blocks))
+	errChan := make(chan error)
+	for j := 0; j < workers; j++ {
+		go func() {
+			for i := range blockIndices {
+				if err := downloadBlockTo(i); err != nil {
+					errChan <- err
+					return
+				}
+			}
+			errChan <- nil
+		}()
+	}
+
+	var ret error
+	for j := 0; j < workers; j++ {
+		err := <-errChan
+		if err != nil && ret == nil {
+			ret = err
+			reader.cancel()
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,106 @@
+package proton_api_bridge
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/henrybear327/Proton-API-Bridge/common"
+	"golang.org/x/sync/semaphore"
+)
+
+func TestDownloadBlocksTo(t *testing.T) {
+	blocks := [][]byte{[]byte("block 0,"), []byte("block 1,"), []byte("block 2,"), []byte("block 3,"), []byte("block 4")}
+
+	for _, tc := range []struct {
+		name        string
+		concurrency int
+		blockSizes  bool
+	}{
+		{"sequential", 1, true},
+		{"concurrent", 3, true},
+		{"no concurrency configured", 0, true},
+		{"no block sizes", 3, false},
+	} {
+		var inFlight, maxInFlight atomic.Int32
+		var encBlocks [][]byte
+		api := &fakeDriveAPI{
+			getBlock: func(ctx context.Context, bareURL, token string) (io.ReadCloser, error) {
+				n := inFlight.Add(1)
+				defer inFlight.Add(-1)
+				for {
+					m := maxInFlight.Load()
+					if n <= m || maxInFlight.CompareAndSwap(m, n) {
+						break
+					}
+				}
+
+				i, _ := strconv.Atoi(bareURL)
+				return io.NopCloser(bytes.NewReader(encBlocks[i])), nil
+			},
+		}
+		reader, encBlocks := newTestReadAheadReader(t, api, 0, blocks...)
+		reader.protonDrive.Config = &common.Config{ConcurrentBlockDownloadCount: tc.concurrency}
+		reader.protonDrive.blockDownloadSemaphore = semaphore.NewWeighted(int64(len(blocks)))
+		if !tc.blockSizes {
+			reader.blockOffsets = nil
+		}
+
+		file, err := os.Create(filepath.Join(t.TempDir(), "file"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = reader.protonDrive.downloadBlocksTo(reader, file)
+		reader.Close()
+		file.Close()
+		if err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+
+		data, err := os.ReadFile(file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := bytes.Join(blocks, nil); !bytes.Equal(data, expected) {
+			t.Fatalf("%v: expected %q, got %q", tc.name, expected, data)
+		}
+		if maxInFlight.Load() > int32(max(tc.concurrency, 1)) {
+			t.Fatalf("%v: expected at most %v blocks in flight, got %v", tc.name, max(tc.concurrency, 1), maxInFlight.Load())
+		}
+	}
+}
+
+func TestDownloadBlocksToError(t *testing.T) {
+	blocks := [][]byte{[]byte("block 0,"), []byte("block 1,"), []byte("block 2")}
+	errBlock := errors.New("block 1 is unavailable")
+
+	var encBlocks [][]byte
+	api := &fakeDriveAPI{
+		getBlock: func(ctx context.Context, bareURL, token string) (io.ReadCloser, error) {
+			if bareURL == "1" {
+				return nil, errBlock
+			}
+			i, _ := strconv.Atoi(bareURL)
+			return io.NopCloser(bytes.NewReader(encBlocks[i])), nil
+		},
+	}
+	reader, encBlocks := newTestReadAheadReader(t, api, 0, blocks...)
+	defer reader.Close()
+	reader.protonDrive.Config = &common.Config{ConcurrentBlockDownloadCount: 2}
+	reader.protonDrive.blockDownloadSemaphore = semaphore.NewWeighted(2)
+
+	file, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := reader.protonDrive.downloadBlocksTo(reader, file); !errors.Is(err, errBlock) {
+		t.Fatalf("expected the error of block 1, got %v", err)
+	}
+}
@@ -0,0 +1,578 @@
+package proton_api_bridge
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"golang.org/x/sync/semaphore"
+)
+
+// newTestDownloadReader returns a reader whose blocks are all already decrypted, so no network access is needed
+func newTestDownloadReader(blocks ...[]byte) *FileDownloadReader {
+	reader := &FileDownloadReader{
+		protonDrive: &ProtonDrive{},
+		cancel:      func() {},
+		data:        bytes.NewBuffer(nil),
+		revision:    &proton.Revision{Blocks: make([]proton.Block, len(blocks))},
+		endBlock:    len(blocks),
+		rangeEnd:    -1,
+	}
+
+	totalBytes := int64(0)
+	for i := range blocks {
+		reader.blockOffsets = append(reader.blockOffsets, totalBytes)
+		totalBytes += int64(len(blocks[i]))
+		reader.recentBlocks = append(reader.recentBlocks, &decryptedBlock{index: i, data: blocks[i]})
+	}
+	reader.blockOffsets = append(reader.blockOffsets, totalBytes)
+
+	return reader
+}
+
+func TestDownloadReaderLocateBlock(t *testing.T) {
+	reader := newTestDownloadReader([]byte("0123"), []byte("4567"), []byte("89"))
+
+	for _, tc := range []struct {
+		offset      int64
+		index       int
+		blockOffset int64
+	}{
+		{0, 0, 0},
+		{3, 0, 3},
+		{4, 1, 0},
+		{9, 2, 1},
+		{10, 3, 0},
+		{100, 3, 0},
+	} {
+		index, blockOffset := reader.locateBlock(tc.offset)
+		if index != tc.index || blockOffset != tc.blockOffset {
+			t.Fatalf("offset %v: expected (%v, %v), got (%v, %v)", tc.offset, tc.index, tc.blockOffset, index, blockOffset)
+		}
+	}
+}
+
+func TestDownloadReaderSeekAndReadAt(t *testing.T) {
+	reader := newTestDownloadReader([]byte("0123"), []byte("4567"), []byte("89"))
+
+	p := make([]byte, 5)
+	n, err := reader.ReadAt(p, 2)
+	if err != nil || string(p[:n]) != "23456" {
+		t.Fatalf("ReadAt: got %q, %v", p[:n], err)
+	}
+
+	n, err = reader.ReadAt(p, 7)
+	if err != io.EOF || string(p[:n]) != "789" {
+		t.Fatalf("ReadAt past the end: got %q, %v", p[:n], err)
+	}
+
+	if _, err := reader.Seek(-3, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := io.ReadAll(reader)
+	if err != nil || string(rest) != "789" {
+		t.Fatalf("Read after Seek: got %q, %v", rest, err)
+	}
+
+	if _, err := reader.Seek(1, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.Seek(2, io.SeekCurrent); err != nil {
+		t.Fatal(err)
+	}
+	rest, err = io.ReadAll(reader)
+	if err != nil || string(rest) != "3456789" {
+		t.Fatalf("Read after relative Seek: got %q, %v", rest, err)
+	}
+}
+
+func TestDownloadReaderLimitToRange(t *testing.T) {
+	for _, tc := range []struct {
+		offset, length int64
+		expected       string
+		endBlock       int
+	}{
+		{0, 10, "0123456789", 3},
+		{2, 4, "2345", 2},
+		{4, 4, "4567", 2},
+		{5, 100, "56789", 3},
+		{10, 5, "", 3},
+	} {
+		reader := newTestDownloadReader([]byte("0123"), []byte("4567"), []byte("89"))
+
+		n, err := reader.limitToRange(tc.offset, tc.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reader.endBlock != tc.endBlock {
+			t.Fatalf("range (%v, %v): expected end block %v, got %v", tc.offset, tc.length, tc.endBlock, reader.endBlock)
+		}
+
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tc.expected || n != int64(len(data)) {
+			t.Fatalf("range (%v, %v): expected %q, got %q with count %v", tc.offset, tc.length, tc.expected, data, n)
+		}
+	}
+
+	reader := newTestDownloadReader([]byte("0123"))
+	if _, err := reader.limitToRange(5, 1); err != ErrInvalidDownloadRange {
+		t.Fatalf("expected ErrInvalidDownloadRange, got %v", err)
+	}
+}
+
+func TestDownloadReaderLimitToRangeWithoutBlockSizes(t *testing.T) {
+	for _, tc := range []struct {
+		offset, length int64
+		size           int64 // of the xattr, 0 if missing
+		expected       string
+		count          int64
+	}{
+		{2, 4, 10, "2345", 4},
+		{5, 100, 10, "56789", 5},
+		{5, 100, 0, "56789", 100},
+		{10, 5, 10, "", 0},
+	} {
+		reader := newTestDownloadReader([]byte("0123"), []byte("4567"), []byte("89"))
+		reader.blockOffsets = nil
+		reader.fileSystemAttrs = &FileSystemAttrs{Size: tc.size}
+
+		n, err := reader.limitToRange(tc.offset, tc.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tc.expected || n != tc.count {
+			t.Fatalf("range (%v, %v): expected %q with count %v, got %q with count %v", tc.offset, tc.length, tc.expected, tc.count, data, n)
+		}
+	}
+}
+
+func TestDownloadReaderVerifyIntegrity(t *testing.T) {
+	content := []byte("0123456789")
+	sha1Hash := sha1.Sum(content)
+
+	for _, tc := range []struct {
+		size          int64
+		digests       string
+		expectedField string
+	}{
+		{10, hex.EncodeToString(sha1Hash[:]), ""},
+		{10, "", ""},
+		{0, hex.EncodeToString(sha1Hash[:]), ""}, // the size wasn't recorded
+		{0, hex.EncodeToString(make([]byte, sha1.Size)), "SHA1"},
+		{11, hex.EncodeToString(sha1Hash[:]), "Size"},
+		{10, hex.EncodeToString(make([]byte, sha1.Size)), "SHA1"},
+	} {
+		reader := newTestDownloadReader(content[:4], content[4:8], content[8:])
+		reader.fileSystemAttrs = &FileSystemAttrs{Size: tc.size, Digests: tc.digests}
+		reader.sha1Digests = sha1.New()
+
+		_, err := io.ReadAll(reader)
+		if tc.expectedField == "" {
+			if err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		var integrityError *FileIntegrityError
+		if !errors.As(err, &integrityError) || integrityError.Field != tc.expectedField {
+			t.Fatalf("expected %v mismatch, got %v", tc.expectedField, err)
+		}
+		if !errors.Is(err, ErrDownloadedFileIntegrityCheckFailed) {
+			t.Fatalf("expected ErrDownloadedFileIntegrityCheckFailed, got %v", err)
+		}
+	}
+}
+
+func TestVerifyManifestSignature(t *testing.T) {
+	kr := newTestKeyRing(t)
+
+	manifestSignatureData := make([]byte, 0)
+	revision := &proton.Revision{}
+	for i := 1; i <= 3; i++ {
+		hash := sha256.Sum256([]byte{byte(i)})
+		manifestSignatureData = append(manifestSignatureData, hash[:]...)
+		revision.Blocks = append(revision.Blocks, proton.Block{
+			Index: i,
+			Hash:  base64.StdEncoding.EncodeToString(hash[:]),
+		})
+	}
+	signature, err := kr.SignDetached(crypto.NewPlainMessage(manifestSignatureData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	revision.ManifestSignature, err = signature.GetArmored()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifyManifestSignature(revision, kr); err != nil {
+		t.Fatal(err)
+	}
+
+	revision.Blocks[0].Hash, revision.Blocks[1].Hash = revision.Blocks[1].Hash, revision.Blocks[0].Hash
+	if err := verifyManifestSignature(revision, kr); err != ErrManifestSignatureVerificationFailed {
+		t.Fatalf("expected ErrManifestSignatureVerificationFailed, got %v", err)
+	}
+
+	revision.Blocks = revision.Blocks[1:]
+	if err := verifyManifestSignature(revision, kr); err != ErrBlockListIncomplete {
+		t.Fatalf("expected ErrBlockListIncomplete, got %v", err)
+	}
+}
+
+// newTestReadAheadReader returns a reader fetching the blocks from api, where the BareURL of a block is its position,
+// together with the encrypted blocks for api to serve
+func newTestReadAheadReader(t *testing.T, api *fakeDriveAPI, readAhead int, blocks ...[]byte) (*FileDownloadReader, [][]byte) {
+	addrKR := newTestKeyRing(t)
+	protonDrive := &ProtonDrive{
+		DefaultAddrKR:        addrKR,
+		addrKRs:              map[string]*crypto.KeyRing{"addressID": addrKR},
+		addrData:             map[string]proton.Address{"user@proton.me": {ID: "addressID", Email: "user@proton.me"}},
+		api:                  api,
+		blockCryptoSemaphore: semaphore.NewWeighted(int64(len(blocks))),
+	}
+	nodeKR := newTestKeyRing(t)
+	sessionKey, err := crypto.GenerateSessionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revision := &proton.Revision{}
+	encBlocks := make([][]byte, 0, len(blocks))
+	blockOffsets := []int64{0}
+	for i := range blocks {
+		blockOffsets = append(blockOffsets, blockOffsets[i]+int64(len(blocks[i])))
+
+		encryptedBlock := protonDrive.encryptBlock(context.Background(), sessionKey, nodeKR, i+1, blocks[i])
+		if encryptedBlock.err != nil {
+			t.Fatal(encryptedBlock.err)
+		}
+		encBlocks = append(encBlocks, encryptedBlock.encData)
+		revision.Blocks = append(revision.Blocks, proton.Block{
+			Index:        i + 1,
+			BareURL:      strconv.Itoa(i),
+			Hash:         encryptedBlock.blockUploadInfo.Hash,
+			EncSignature: encryptedBlock.blockUploadInfo.EncSignature,
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &FileDownloadReader{
+		protonDrive: protonDrive,
+		ctx:         ctx,
+		cancel:      cancel,
+		link:        &proton.Link{SignatureEmail: "user@proton.me"},
+		data:        bytes.NewBuffer(nil),
+		nodeKR:      nodeKR,
+		sessionKey:  sessionKey,
+		revision:    revision,
+		endBlock:    len(blocks),
+		readAhead:   readAhead,
+		rangeEnd:    -1,
+		progress:    NopProgressReporter{},
+
+		blockOffsets: blockOffsets,
+	}, encBlocks
+}
+
+func TestDownloadReaderReadAheadInOrder(t *testing.T) {
+	blocks := [][]byte{[]byte("block 0,"), []byte("block 1,"), []byte("block 2,"), []byte("block 3,"), []byte("block 4")}
+
+	var encBlocks [][]byte
+	api := &fakeDriveAPI{
+		getBlock: func(ctx context.Context, bareURL, token string) (io.ReadCloser, error) {
+			i, _ := strconv.Atoi(bareURL)
+			// the later blocks are ready first
+			time.Sleep(time.Duration(len(encBlocks)-i) * 5 * time.Millisecond)
+			return io.NopCloser(bytes.NewReader(encBlocks[i])), nil
+		},
+	}
+	reader, encBlocks := newTestReadAheadReader(t, api, 3, blocks...)
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := bytes.Join(blocks, nil); !bytes.Equal(data, expected) {
+		t.Fatalf("expected %q, got %q", expected, data)
+	}
+}
+
+func TestDownloadReaderReadAheadError(t *testing.T) {
+	blocks := [][]byte{[]byte("block 0,"), []byte("block 1,"), []byte("block 2,"), []byte("block 3")}
+	errBlock := errors.New("block 2 is unavailable")
+
+	var encBlocks [][]byte
+	api := &fakeDriveAPI{
+		getBlock: func(ctx context.Context, bareURL, token string) (io.ReadCloser, error) {
+			i, _ := strconv.Atoi(bareURL)
+			if i == 2 {
+				return nil, errBlock
+			}
+			return io.NopCloser(bytes.NewReader(encBlocks[i])), nil
+		},
+	}
+	reader, encBlocks := newTestReadAheadReader(t, api, 3, blocks...)
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if !errors.Is(err, errBlock) {
+		t.Fatalf("expected the error of block 2, got %v", err)
+	}
+	if expected := bytes.Join(blocks[:2], nil); !bytes.Equal(data, expected) {
+		t.Fatalf("expected %q before the error, got %q", expected, data)
+	}
+}
+
+func TestDownloadReaderCloseCancelsPrefetch(t *testing.T) {
+	blocks := [][]byte{[]byte("block 0,"), []byte("block 1,"), []byte("block 2,"), []byte("block 3")}
+
+	var encBlocks [][]byte
+	canceled := make(chan string, len(blocks))
+	api := &fakeDriveAPI{
+		getBlock: func(ctx context.Context, bareURL, token string) (io.ReadCloser, error) {
+			if bareURL == "0" {
+				return io.NopCloser(bytes.NewReader(encBlocks[0])), nil
+			}
+
+			// the other blocks never arrive
+			<-ctx.Done()
+			canceled <- bareURL
+			return nil, ctx.Err()
+		},
+	}
+	reader, encBlocks := newTestReadAheadReader(t, api, 3, blocks...)
+
+	p := make([]byte, len(blocks[0]))
+	if _, err := io.ReadFull(reader, p); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// block 0 has been consumed, and blocks 1 to 3 are in flight
+	for i := 1; i < len(blocks); i++ {
+		select {
+		case <-canceled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the prefetching of %v blocks to be canceled, got %v", len(blocks)-1, i-1)
+		}
+	}
+}
+
+func TestDownloadReaderSeekIsLazy(t *testing.T) {
+	var fetches atomic.Int32
+	var encBlocks [][]byte
+	api := &fakeDriveAPI{
+		getBlock: func(ctx context.Context, bareURL, token string) (io.ReadCloser, error) {
+			fetches.Add(1)
+			i, _ := strconv.Atoi(bareURL)
+			return io.NopCloser(bytes.NewReader(encBlocks[i])), nil
+		},
+	}
+	reader, encBlocks := newTestReadAheadReader(t, api, 0, []byte("0123"), []byte("4567"), []byte("89"))
+	defer reader.Close()
+
+	read := func(expected string, expectedFetches int32) {
+		t.Helper()
+		p := make([]byte, len(expected))
+		if _, err := io.ReadFull(reader, p); err != nil {
+			t.Fatal(err)
+		}
+		if string(p) != expected || fetches.Load() != expectedFetches {
+			t.Fatalf("expected %q after %v fetches, got %q after %v", expected, expectedFetches, p, fetches.Load())
+		}
+	}
+
+	for _, seek := range []struct {
+		offset int64
+		whence int
+	}{{0, io.SeekCurrent}, {9, io.SeekStart}, {5, io.SeekStart}} {
+		if _, err := reader.Seek(seek.offset, seek.whence); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fetches.Load() != 0 {
+		t.Fatalf("expected Seek not to fetch, got %v fetches", fetches.Load())
+	}
+	read("5", 1)
+
+	// within the current block
+	if _, err := reader.Seek(1, io.SeekCurrent); err != nil {
+		t.Fatal(err)
+	}
+	read("7", 1)
+
+	if _, err := reader.Seek(9, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	read("9", 2)
+}
+
+func TestDownloadReaderShortBlock(t *testing.T) {
+	var encBlocks [][]byte
+	api := &fakeDriveAPI{
+		getBlock: func(ctx context.Context, bareURL, token string) (io.ReadCloser, error) {
+			i, _ := strconv.Atoi(bareURL)
+			return io.NopCloser(bytes.NewReader(encBlocks[i])), nil
+		},
+	}
+	newReader := func() *FileDownloadReader {
+		reader, blocks := newTestReadAheadReader(t, api, 0, []byte("0123"), []byte("45"))
+		encBlocks = blocks
+		// the xattr claims the second block is longer than it is
+		reader.blockOffsets = []int64{0, 4, 10}
+		return reader
+	}
+
+	var integrityErr *FileIntegrityError
+	for _, off := range []int64{6, 8} {
+		reader := newReader()
+		p := make([]byte, 2)
+		_, err := reader.ReadAt(p, off)
+		if !errors.As(err, &integrityErr) || integrityErr.Field != "BlockSizes" {
+			t.Fatalf("ReadAt(%v): expected a BlockSizes mismatch, got %v", off, err)
+		}
+		reader.Close()
+	}
+
+	reader := newReader()
+	defer reader.Close()
+	if _, err := reader.Seek(8, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	_, err := io.ReadAll(reader)
+	if !errors.As(err, &integrityErr) || integrityErr.Field != "BlockSizes" {
+		t.Fatalf("Read after Seek: expected a BlockSizes mismatch, got %v", err)
+	}
+}
+
+func TestDownloadReaderReadAtAfterClose(t *testing.T) {
+	reader := newTestDownloadReader([]byte("0123"))
+	reader.Close()
+
+	if _, err := reader.ReadAt(make([]byte, 1), 0); err != ErrDownloadReaderClosed {
+		t.Fatalf("expected ErrDownloadReaderClosed, got %v", err)
+	}
+	if _, err := reader.Read(make([]byte, 1)); err != ErrDownloadReaderClosed {
+		t.Fatalf("expected ErrDownloadReaderClosed, got %v", err)
+	}
+}
+
+// waitingReader holds its first Read until all the readers sharing arrived are reading
+type waitingReader struct {
+	r       io.Reader
+	arrived *sync.WaitGroup
+	once    sync.Once
+}
+
+func (r *waitingReader) Read(p []byte) (int, error) {
+	r.once.Do(func() {
+		r.arrived.Done()
+		r.arrived.Wait()
+	})
+	return r.r.Read(p)
+}
+
+func TestDownloadBlockYieldsCryptoSemaphoreToNetwork(t *testing.T) {
+	blocks := [][]byte{[]byte("block 0,"), []byte("block 1")}
+
+	var encBlocks [][]byte
+	var arrived sync.WaitGroup
+	arrived.Add(len(blocks))
+	api := &fakeDriveAPI{
+		getBlock: func(ctx context.Context, bareURL, token string) (io.ReadCloser, error) {
+			i, _ := strconv.Atoi(bareURL)
+			return io.NopCloser(&waitingReader{r: bytes.NewReader(encBlocks[i]), arrived: &arrived}), nil
+		},
+	}
+	reader, encBlocks := newTestReadAheadReader(t, api, 0, blocks...)
+	defer reader.Close()
+	// both blocks can only arrive if the first doesn't keep the semaphore while waiting for the network
+	reader.protonDrive.blockCryptoSemaphore = semaphore.NewWeighted(1)
+
+	errChan := make(chan error, len(blocks))
+	for i := range blocks {
+		go func(i int) {
+			errChan <- reader.protonDrive.downloadBlock(reader.ctx, reader.link, reader.nodeKR, reader.sessionKey, &reader.revision.Blocks[i], io.Discard, NopProgressReporter{})
+		}(i)
+	}
+	for range blocks {
+		select {
+		case err := <-errChan:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the downloads are waiting for each other's crypto semaphore")
+		}
+	}
+}
+
+func TestDownloadReaderReadAtMemoryBudget(t *testing.T) {
+	blocks := [][]byte{[]byte("0123"), []byte("4567"), []byte("89")}
+
+	var encBlocks [][]byte
+	api := &fakeDriveAPI{
+		getBlock: func(ctx context.Context, bareURL, token string) (io.ReadCloser, error) {
+			i, _ := strconv.Atoi(bareURL)
+			return io.NopCloser(bytes.NewReader(encBlocks[i])), nil
+		},
+	}
+	reader, encBlocks := newTestReadAheadReader(t, api, 0, blocks...)
+	budget := newMemoryBudget(2 * int64(UPLOAD_BLOCK_SIZE))
+	reader.protonDrive.downloadMemoryBudget = budget
+
+	p := make([]byte, 10)
+	if n, err := reader.ReadAt(p, 0); err != nil || string(p[:n]) != "0123456789" {
+		t.Fatalf("ReadAt: got %q, %v", p[:n], err)
+	}
+	// the third block took over the budget of the first one
+	if len(reader.recentBlocks) != 2 || budget.tryReserveBlock() {
+		t.Fatalf("expected 2 blocks kept within the budget, got %v", len(reader.recentBlocks))
+	}
+
+	// without any budget left, the blocks are still read, but not kept
+	// the kept blocks are forgotten, so they can't make room, but their budget stays taken
+	reader.recentBlocks = nil
+	if n, err := reader.ReadAt(p[:4], 0); err != nil || string(p[:n]) != "0123" {
+		t.Fatalf("ReadAt without budget: got %q, %v", p[:n], err)
+	}
+	if len(reader.recentBlocks) != 0 {
+		t.Fatalf("expected no block to be kept without budget, got %v", len(reader.recentBlocks))
+	}
+	// give back the budget of the forgotten blocks
+	budget.releaseBlock()
+	budget.releaseBlock()
+
+	if _, err := reader.ReadAt(p[:4], 0); err != nil {
+		t.Fatal(err)
+	}
+	reader.Close()
+	if !budget.semaphore.TryAcquire(budget.size) {
+		t.Fatalf("expected Close to release the budget of the kept blocks")
+	}
+}
@@ -0,0 +1,80 @@
+package proton_api_bridge
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+)
+
+func TestRevisionXAttrRoundTrip(t *testing.T) {
+	addrKR := newTestKeyRing(t)
+	nodeKR := newTestKeyRing(t)
+
+	modTime := time.Date(2023, 9, 16, 7, 40, 54, 123456789, time.UTC)
+	creationTime := time.Date(2022, 1, 2, 3, 4, 5, 6, time.UTC)
+	xAttrCommon := newRevisionXAttrCommon(modTime, creationTime, 13, []int64{10, 3}, map[string]string{
+		"SHA1":   "ABCDEF",
+		"SHA256": "0123AB",
+	})
+
+	encXAttr, err := encryptRevisionXAttr(addrKR, nodeKR, xAttrCommon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decXAttr, err := decryptRevisionXAttr(addrKR, nodeKR, &encXAttr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := newFileSystemAttrs(decXAttr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !attrs.ModificationTime.Equal(modTime) {
+		t.Fatalf("expected modification time %v, got %v", modTime, attrs.ModificationTime)
+	}
+	if !attrs.CreationTime.Equal(creationTime) {
+		t.Fatalf("expected creation time %v, got %v", creationTime, attrs.CreationTime)
+	}
+	if attrs.Size != 13 || len(attrs.BlockSizes) != 2 || attrs.Digests != "abcdef" || attrs.SHA256 != "0123ab" {
+		t.Fatalf("unexpected attrs %#v", attrs)
+	}
+
+	if _, err := decryptRevisionXAttr(newTestKeyRing(t), nodeKR, &encXAttr); err == nil {
+		t.Fatalf("the signature of another key should not verify")
+	}
+}
+
+func TestRevisionXAttrFromOfficialClients(t *testing.T) {
+	addrKR := newTestKeyRing(t)
+	nodeKR := newTestKeyRing(t)
+
+	// only the fields known to proton.RevisionXAttrCommon, with second precision
+	encXAttr, err := nodeKR.Encrypt(crypto.NewPlainMessageFromString(`{"Common":{"ModificationTime":"2021-09-16T07:40:54+0000","Size":3,"BlockSizes":[3],"Digests":{"SHA1":"abc"}}}`), addrKR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encXAttrString, err := encXAttr.GetArmored()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decXAttr, err := decryptRevisionXAttr(addrKR, nodeKR, &encXAttrString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := newFileSystemAttrs(decXAttr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !attrs.ModificationTime.Equal(time.Date(2021, 9, 16, 7, 40, 54, 0, time.UTC)) || !attrs.CreationTime.IsZero() || attrs.SHA256 != "" || attrs.Digests != "abc" {
+		t.Fatalf("unexpected attrs %#v", attrs)
+	}
+
+	// nil xattr means no attrs
+	if decXAttr, err := decryptRevisionXAttr(addrKR, nodeKR, (&proton.RevisionMetadata{}).XAttr); decXAttr != nil || err != nil {
+		t.Fatalf("expected no xattr, got %v, %v", decXAttr, err)
+	}
+}
@@ -4,20 +4,31 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/hmac"
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"hash"
 	"io"
-	"mime"
+	"log"
 	"os"
-	"path/filepath"
 	"time"
 
 	"github.com/ProtonMail/gopenpgp/v2/crypto"
 	"github.com/ProtonMail/go-proton-api"
 )
 
+// UploadOptions are the optional settings of a single upload, nil means the defaults
+type UploadOptions struct {
+	MIMEType     string    // overrides the MIME type detection
+	CreationTime time.Time // recorded in the revision xattr, if not zero
+
+	ConflictPolicy ConflictPolicy // what to do if filename is already taken in the folder
+
+	ProgressReporter ProgressReporter // notified as the upload goes, if not nil
+}
+
 func (protonDrive *ProtonDrive) handleRevisionConflict(ctx context.Context, link *proton.Link, createFileResp *proton.CreateFileRes) (string, bool, error) {
 	if link != nil {
 		linkID := link.LinkID
@@ -27,11 +38,13 @@ func (protonDrive *ProtonDrive) handleRevisionConflict(ctx context.Context, link
 			return "", false, err
 		}
 
-		// if we have a draft revision, depending on the user config, we can abort the upload or recreate a draft
+		// if we have a draft revision, depending on who created it and the user config, we can abort the upload or recreate a draft
 		// if we have no draft revision, then we can create a new draft revision directly (there is a restriction of 1 draft revision per file)
 		if len(draftRevision) > 0 {
-			// TODO: maintain clientUID to mark that this is our own draft (which can indicate failed upload attempt!)
-			if protonDrive.Config.ReplaceExistingDraft {
+			// a draft with our own clientUID is a failed upload attempt of ours, as we don't upload the same file twice at the same time
+			isOwnDraft := protonDrive.Config.ClientUID != "" && draftRevision[0].ClientUID == protonDrive.Config.ClientUID
+			isOwnDraft = isOwnDraft || protonDrive.isOwnRevisionDraft(linkID, draftRevision[0].ID)
+			if isOwnDraft || protonDrive.Config.ReplaceExistingDraft {
 				// Question: how do we observe for file upload cancellation -> clientUID?
 				// Random thoughts: if there are concurrent modification to the draft, the server should be able to catch this when commiting the revision
 				// since the manifestSignature (hash) will fail to match
@@ -52,18 +65,25 @@ func (protonDrive *ProtonDrive) handleRevisionConflict(ctx context.Context, link
 				if err != nil {
 					return "", false, err
 				}
+				protonDrive.ownRevisionDrafts.Delete(draftRevision[0].ID)
 			} else {
 				// if there is a draft, based on the web behavior, it will ask if the user wants to replace the failed upload attempt
 				// current behavior, we report an error to not upload the file (conservative)
-				return "", false, ErrDraftExists
+				return "", false, &DraftExistsError{
+					ClientUID: draftRevision[0].ClientUID,
+					Age:       time.Since(time.Unix(draftRevision[0].CreateTime, 0)).Truncate(time.Second),
+				}
 			}
 		}
 
 		// create a new revision
+		// Note: CreateRevision takes no request body in go-proton-api, so unlike a new file, this draft isn't tagged with our clientUID
+		// and the other clients see it as foreign, we recognize it with isOwnRevisionDraft
 		newRevision, err := protonDrive.c.CreateRevision(ctx, protonDrive.MainShare.ShareID, linkID)
 		if err != nil {
 			return "", false, err
 		}
+		protonDrive.ownRevisionDrafts.Store(newRevision.ID, struct{}{})
 
 		return newRevision.ID, false, nil
 	} else if createFileResp != nil {
@@ -74,10 +94,48 @@ func (protonDrive *ProtonDrive) handleRevisionConflict(ctx context.Context, link
 	}
 }
 
-func (protonDrive *ProtonDrive) createFileUploadDraft(ctx context.Context, parentLink *proton.Link, filename string, modTime time.Time, mimeType string) (string, string, *crypto.SessionKey, *crypto.KeyRing, error) {
+/*
+isOwnRevisionDraft tells if the revision draft revisionID is a failed upload attempt of ours, although it isn't tagged with our clientUID.
+Either we created it in this process, or the upload journal of it is still there.
+*/
+func (protonDrive *ProtonDrive) isOwnRevisionDraft(linkID, revisionID string) bool {
+	if _, ok := protonDrive.ownRevisionDrafts.Load(revisionID); ok {
+		return true
+	}
+
+	if protonDrive.Config.UploadJournalDir != "" {
+		_, err := os.Stat(uploadJournalPath(protonDrive.Config.UploadJournalDir, linkID, revisionID))
+		return err == nil
+	}
+
+	return false
+}
+
+// searchFileByGivenName returns the active or draft file named givenName, nil if there's none, or if givenName doesn't merely differ by its normalization
+func (protonDrive *ProtonDrive) searchFileByGivenName(ctx context.Context, parentLink *proton.Link, givenName, filename string) (*proton.Link, error) {
+	if givenName == filename || NormalizeName(givenName) != filename {
+		return nil, nil
+	}
+
+	link, err := protonDrive.SearchByNameInActiveFolder(ctx, parentLink, givenName, true, false, proton.LinkStateActive)
+	if err != nil || link != nil {
+		return link, err
+	}
+
+	return protonDrive.SearchByNameInActiveFolder(ctx, parentLink, givenName, true, false, proton.LinkStateDraft)
+}
+
+/*
+createFileUploadDraft returns the name the draft is created with, which differs from filename if it's renamed by ConflictPolicyKeepBoth,
+or if it goes into an existing file named givenName.
+
+filename is the validated givenName. If they only differ by the normalization, e.g. givenName is in NFD, an existing file named givenName
+is looked up first, as the server only compares the hashes of the names, and wouldn't see it as a conflict.
+*/
+func (protonDrive *ProtonDrive) createFileUploadDraft(ctx context.Context, parentLink *proton.Link, givenName, filename string, modTime time.Time, mimeType string, conflictPolicy ConflictPolicy) (string, string, string, *crypto.SessionKey, *crypto.KeyRing, error) {
 	parentNodeKR, err := protonDrive.getLinkKR(ctx, parentLink)
 	if err != nil {
-		return "", "", nil, nil, err
+		return "", "", "", nil, nil, err
 	}
 
 	/*
@@ -86,7 +144,7 @@ func (protonDrive *ProtonDrive) createFileUploadDraft(ctx context.Context, paren
 	*/
 	newNodeKey, newNodePassphraseEnc, newNodePassphraseSignature, err := generateNodeKeys(parentNodeKR, protonDrive.DefaultAddrKR)
 	if err != nil {
-		return "", "", nil, nil, err
+		return "", "", "", nil, nil, err
 	}
 
 	createFileReq := proton.CreateFileReq{
@@ -96,6 +154,8 @@ func (protonDrive *ProtonDrive) createFileUploadDraft(ctx context.Context, paren
 		// Hash     string // Encrypted File Name hash
 		MIMEType: mimeType, // MIME Type
 
+		ClientUID: protonDrive.Config.ClientUID, // marks the draft as ours, see handleRevisionConflict
+
 		// ContentKeyPacket          string // The block's key packet, encrypted with the node key.
 		// ContentKeyPacketSignature string // Unencrypted signature of the content session key, signed with the NodeKey
 
@@ -112,7 +172,7 @@ func (protonDrive *ProtonDrive) createFileUploadDraft(ctx context.Context, paren
 	*/
 	err = createFileReq.SetName(filename, protonDrive.DefaultAddrKR, parentNodeKR)
 	if err != nil {
-		return "", "", nil, nil, err
+		return "", "", "", nil, nil, err
 	}
 
 	/*
@@ -121,17 +181,17 @@ func (protonDrive *ProtonDrive) createFileUploadDraft(ctx context.Context, paren
 	*/
 	signatureVerificationKR, err := protonDrive.getSignatureVerificationKeyring([]string{parentLink.SignatureEmail}, parentNodeKR)
 	if err != nil {
-		return "", "", nil, nil, err
+		return "", "", "", nil, nil, err
 	}
 	parentHashKey, err := parentLink.GetHashKey(parentNodeKR, signatureVerificationKR)
 	if err != nil {
-		return "", "", nil, nil, err
+		return "", "", "", nil, nil, err
 	}
 
 	/* Use parent's hash key */
 	err = createFileReq.SetHash(filename, parentHashKey)
 	if err != nil {
-		return "", "", nil, nil, err
+		return "", "", "", nil, nil, err
 	}
 
 	/*
@@ -140,7 +200,7 @@ func (protonDrive *ProtonDrive) createFileUploadDraft(ctx context.Context, paren
 	*/
 	newNodeKR, err := getKeyRing(parentNodeKR, protonDrive.DefaultAddrKR, newNodeKey, newNodePassphraseEnc, newNodePassphraseSignature)
 	if err != nil {
-		return "", "", nil, nil, err
+		return "", "", "", nil, nil, err
 	}
 
 	/*
@@ -149,20 +209,58 @@ func (protonDrive *ProtonDrive) createFileUploadDraft(ctx context.Context, paren
 	*/
 	newSessionKey, err := createFileReq.SetContentKeyPacketAndSignature(newNodeKR)
 	if err != nil {
-		return "", "", nil, nil, err
+		return "", "", "", nil, nil, err
 	}
 
+	name := filename
 	createFileAction := func() (*proton.CreateFileRes, *proton.Link, error) {
-		createFileResp, err := protonDrive.c.CreateFile(ctx, protonDrive.MainShare.ShareID, createFileReq)
+		existingLink, err := protonDrive.searchFileByGivenName(ctx, parentLink, givenName, filename)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var createFileResp proton.CreateFileRes
+		if existingLink != nil {
+			err = proton.ErrFileNameExist
+		} else {
+			createFileResp, err = protonDrive.c.CreateFile(ctx, protonDrive.MainShare.ShareID, createFileReq)
+		}
+		for attempt := 0; err == proton.ErrFileNameExist && conflictPolicy == ConflictPolicyKeepBoth && attempt < NAME_CONFLICT_RETRY_COUNT; attempt++ {
+			name, err = protonDrive.findAvailableName(ctx, parentLink, parentHashKey, filename, true)
+			if err != nil {
+				return nil, nil, err
+			}
+			err = createFileReq.SetName(name, protonDrive.DefaultAddrKR, parentNodeKR)
+			if err != nil {
+				return nil, nil, err
+			}
+			err = createFileReq.SetHash(name, parentHashKey)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			createFileResp, err = protonDrive.c.CreateFile(ctx, protonDrive.MainShare.ShareID, createFileReq)
+		}
 		if err != nil {
 			// FIXME: check for duplicated filename by relying on checkAvailableHashes -> able to retrieve linkID too
 			// Also saving generating resources such as new nodeKR, etc.
 
-			if err != proton.ErrFileNameExist {
+			if err != proton.ErrFileNameExist || conflictPolicy == ConflictPolicyFail || conflictPolicy == ConflictPolicyKeepBoth {
 				// other real error caught
 				return nil, nil, err
 			}
 
+			if existingLink != nil {
+				givenNameHash, err := proton.GetNameHash(givenName, parentHashKey)
+				if err != nil {
+					return nil, nil, err
+				}
+				if existingLink.Hash == givenNameHash {
+					name = givenName
+				}
+				return nil, existingLink, nil
+			}
+
 			// search for the link within this folder which has an active/draft revision as we have a file creation conflict
 			link, err := protonDrive.SearchByNameInActiveFolder(ctx, parentLink, filename, true, false, proton.LinkStateActive)
 			if err != nil {
@@ -190,12 +288,12 @@ func (protonDrive *ProtonDrive) createFileUploadDraft(ctx context.Context, paren
 
 	createFileResp, link, err := createFileAction()
 	if err != nil {
-		return "", "", nil, nil, err
+		return "", "", "", nil, nil, err
 	}
 
 	revisionID, shouldSubmitCreateFileRequestAgain, err := protonDrive.handleRevisionConflict(ctx, link, createFileResp)
 	if err != nil {
-		return "", "", nil, nil, err
+		return "", "", "", nil, nil, err
 	}
 
 	if shouldSubmitCreateFileRequestAgain {
@@ -203,12 +301,12 @@ func (protonDrive *ProtonDrive) createFileUploadDraft(ctx context.Context, paren
 		// we need to delete the link and recreate one
 		createFileResp, link, err = createFileAction()
 		if err != nil {
-			return "", "", nil, nil, err
+			return "", "", "", nil, nil, err
 		}
 
 		revisionID, _, err = protonDrive.handleRevisionConflict(ctx, link, createFileResp)
 		if err != nil {
-			return "", "", nil, nil, err
+			return "", "", "", nil, nil, err
 		}
 	}
 
@@ -219,40 +317,248 @@ func (protonDrive *ProtonDrive) createFileUploadDraft(ctx context.Context, paren
 		// get original sessionKey and nodeKR for the current link
 		parentNodeKR, err = protonDrive.getLinkKRByID(ctx, link.ParentLinkID)
 		if err != nil {
-			return "", "", nil, nil, err
+			return "", "", "", nil, nil, err
 		}
 		signatureVerificationKR, err := protonDrive.getSignatureVerificationKeyring([]string{link.SignatureEmail})
 		if err != nil {
-			return "", "", nil, nil, err
+			return "", "", "", nil, nil, err
 		}
 		newNodeKR, err = link.GetKeyRing(parentNodeKR, signatureVerificationKR)
 		if err != nil {
-			return "", "", nil, nil, err
+			return "", "", "", nil, nil, err
 		}
 		newSessionKey, err = link.GetSessionKey(newNodeKR)
 		if err != nil {
-			return "", "", nil, nil, err
+			return "", "", "", nil, nil, err
 		}
 	} else {
 		linkID = createFileResp.ID
 	}
 
-	return linkID, revisionID, newSessionKey, newNodeKR, nil
+	return linkID, revisionID, name, newSessionKey, newNodeKR, nil
 }
 
-func (protonDrive *ProtonDrive) uploadAndCollectBlockData(ctx context.Context, newSessionKey *crypto.SessionKey, newNodeKR *crypto.KeyRing, file io.Reader, linkID, revisionID string) ([]byte, int64, []int64, string, error) {
-	type PendingUploadBlocks struct {
-		blockUploadInfo proton.BlockUploadInfo
-		encData         []byte
+type pendingUploadBlock struct {
+	blockUploadInfo proton.BlockUploadInfo
+	encData         []byte
+	hash            []byte // raw sha256 of encData, for the manifest signature
+	plainHMAC       string // base64 HMAC of the plaintext, for the upload journal
+	plainSize       int64  // for the progress reporter
+	uploaded        bool   // already uploaded by a previous attempt, see ResumeUpload
+	memoryReserved  bool   // holds a block of the memory budget until uploaded
+	err             error
+}
+
+// encryptBlock encrypts, signs, and hashes one block, at most ConcurrentFileCryptoCount blocks are processed at the same time
+func (protonDrive *ProtonDrive) encryptBlock(ctx context.Context, newSessionKey *crypto.SessionKey, newNodeKR *crypto.KeyRing, index int, data []byte) pendingUploadBlock {
+	if err := protonDrive.blockCryptoSemaphore.Acquire(ctx, 1); err != nil {
+		return pendingUploadBlock{err: err}
+	}
+	defer protonDrive.blockCryptoSemaphore.Release(1)
+
+	// encrypt block data
+	/*
+		Encryption: current link's session key
+		Signature: share's signature address keys
+	*/
+	dataPlainMessage := crypto.NewPlainMessage(data)
+	encData, err := newSessionKey.Encrypt(dataPlainMessage)
+	if err != nil {
+		return pendingUploadBlock{err: err}
+	}
+
+	encSignature, err := protonDrive.DefaultAddrKR.SignDetachedEncrypted(dataPlainMessage, newNodeKR)
+	if err != nil {
+		return pendingUploadBlock{err: err}
+	}
+	encSignatureStr, err := encSignature.GetArmored()
+	if err != nil {
+		return pendingUploadBlock{err: err}
+	}
+
+	h := sha256.New()
+	h.Write(encData)
+	hash := h.Sum(nil)
+	base64Hash := base64.StdEncoding.EncodeToString(hash)
+
+	return pendingUploadBlock{
+		blockUploadInfo: proton.BlockUploadInfo{
+			Index:        index, // iOS drive: BE starts with 1
+			Size:         int64(len(encData)),
+			EncSignature: encSignatureStr,
+			Hash:         base64Hash,
+		},
+		encData:   encData,
+		hash:      hash,
+		plainSize: int64(len(data)),
 	}
+}
+
+/*
+The upload runs as a pipeline of 3 stages working at the same time
+ 1. a reader, which cuts the file into blocks, and computes the SHA1 digest and block sizes over the plaintext
+ 2. a crypto goroutine per block, gated by blockCryptoSemaphore, which encrypts, signs, and hashes the block
+ 3. the uploader (the calling goroutine), which collects the blocks in order, and uploads them in batches of UPLOAD_BATCH_BLOCK_SIZE
+
+The blocks are handed from stage 1 to stage 3 as a queue of per-block result channels,
+so the blocks stay in order no matter which crypto goroutine finishes first.
+
+If journal is not nil, the blocks are recorded in it once uploaded, and the blocks it already has are not uploaded again.
+These are still reported as uploaded to progress, so the reported sizes add up to the file size.
 
+The returned digests are keyed by algorithm name, as in the revision xattr.
+*/
+func (protonDrive *ProtonDrive) uploadAndCollectBlockData(ctx context.Context, newSessionKey *crypto.SessionKey, newNodeKR *crypto.KeyRing, file io.Reader, linkID, revisionID string, journal *uploadJournal, progress ProgressReporter) ([]byte, int64, []int64, map[string]string, error) {
 	if newSessionKey == nil || newNodeKR == nil {
-		return nil, 0, nil, "", ErrMissingInputUploadAndCollectBlockData
+		return nil, 0, nil, nil, ErrMissingInputUploadAndCollectBlockData
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	readerDone := make(chan struct{})
+	// bounds the blocks held in memory, while allowing the next batch to be read and encrypted during the upload of the current one
+	encryptedBlocks := make(chan chan pendingUploadBlock, UPLOAD_BATCH_BLOCK_SIZE)
+	pendingUploadBlocks := make([]pendingUploadBlock, 0, UPLOAD_BATCH_BLOCK_SIZE)
+	defer func() {
+		// stop the other stages, and make sure nothing is reading from file anymore once we return
+		cancel()
+		<-readerDone
+
+		// give back the memory budget of the blocks we won't upload
+		for range pendingUploadBlocks {
+			protonDrive.uploadMemoryBudget.releaseBlock()
+		}
+		for result := range encryptedBlocks {
+			if block := <-result; block.memoryReserved {
+				protonDrive.uploadMemoryBudget.releaseBlock()
+			}
+		}
+	}()
+
+	uploadedBlocks := make(map[int]uploadJournalBlock)
+	if journal != nil {
+		for _, uploadedBlock := range journal.UploadedBlocks {
+			uploadedBlocks[uploadedBlock.Index] = uploadedBlock
+		}
 	}
 
+	// only accessed by the reader until encryptedBlocks is closed
 	totalFileSize := int64(0)
+	sha1Digests := sha1.New()
+	var sha256Digests hash.Hash
+	if protonDrive.Config.UploadSHA256Digest {
+		sha256Digests = sha256.New()
+	}
+	blockSizes := make([]int64, 0)
+	go func() {
+		defer close(readerDone)
+		defer close(encryptedBlocks)
+
+		queue := func(result chan pendingUploadBlock) bool {
+			select {
+			case encryptedBlocks <- result:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		resumedBlocks := 0
+		shouldContinue := true
+		for i := 1; shouldContinue && ctx.Err() == nil; i++ {
+			result := make(chan pendingUploadBlock, 1)
+
+			// read at most data of size UPLOAD_BLOCK_SIZE
+			// for some reason, .Read might not actually read up to buffer size -> use io.ReadFull
+			buffer, data := getUploadBlockBuffer() // FIXME: get block size from the server config instead of hardcoding it
+			readBytes, err := io.ReadFull(file, data)
+			if err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					// might still have data to read!
+					if readBytes == 0 {
+						putBlockBuffer(buffer)
+						break
+					}
+					shouldContinue = false
+				} else {
+					// all other errors
+					putBlockBuffer(buffer)
+					result <- pendingUploadBlock{err: err}
+					queue(result)
+					return
+				}
+			}
+			data = data[:readBytes]
+			totalFileSize += int64(readBytes)
+			progress.BytesRead(int64(readBytes))
+			sha1Digests.Write(data)
+			if sha256Digests != nil {
+				sha256Digests.Write(data)
+			}
+			blockSizes = append(blockSizes, int64(readBytes))
+
+			plainHMAC := ""
+			if journal != nil {
+				mac := hmac.New(sha256.New, newSessionKey.Key)
+				mac.Write(data)
+				plainHMAC = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+			}
+
+			if uploadedBlock, ok := uploadedBlocks[i]; ok {
+				// no need to encrypt it again, but the content must be what has been uploaded
+				putBlockBuffer(buffer)
+				resumedBlocks++
+				hash, err := base64.StdEncoding.DecodeString(uploadedBlock.Hash)
+				if err != nil || uploadedBlock.PlainHMAC != plainHMAC {
+					result <- pendingUploadBlock{err: ErrUploadSourceChanged}
+					queue(result)
+					return
+				}
+
+				result <- pendingUploadBlock{
+					blockUploadInfo: proton.BlockUploadInfo{
+						Index: i,
+						Hash:  uploadedBlock.Hash,
+					},
+					hash:      hash,
+					plainHMAC: plainHMAC,
+					plainSize: int64(readBytes),
+					uploaded:  true,
+				}
+			} else {
+				// only reserved once read, so none of the budget is held while waiting for file, which might be one of our downloads
+				if err := protonDrive.uploadMemoryBudget.reserveBlock(ctx); err != nil {
+					putBlockBuffer(buffer)
+					return
+				}
+
+				go func(index int, buffer *bytes.Buffer, data []byte) {
+					block := protonDrive.encryptBlock(ctx, newSessionKey, newNodeKR, index, data)
+					putBlockBuffer(buffer)
+					block.plainHMAC = plainHMAC
+					block.memoryReserved = true
+					if block.err == nil {
+						progress.BlockEncrypted(index, block.plainSize)
+					}
+					result <- block
+				}(i, buffer, data)
+			}
+
+			if !queue(result) {
+				if block := <-result; block.memoryReserved {
+					protonDrive.uploadMemoryBudget.releaseBlock()
+				}
+				return
+			}
+		}
+
+		if resumedBlocks != len(uploadedBlocks) {
+			// the file got shorter than what has been uploaded
+			result := make(chan pendingUploadBlock, 1)
+			result <- pendingUploadBlock{err: ErrUploadSourceChanged}
+			queue(result)
+		}
+	}()
 
-	pendingUploadBlocks := make([]PendingUploadBlocks, 0)
 	manifestSignatureData := make([]byte, 0)
 	uploadPendingBlocks := func() error {
 		if len(pendingUploadBlocks) == 0 {
@@ -271,121 +577,204 @@ func (protonDrive *ProtonDrive) uploadAndCollectBlockData(ctx context.Context, n
 
 			BlockList: blockList,
 		}
-		blockUploadResp, err := protonDrive.c.RequestBlockUpload(ctx, blockUploadReq)
+		blockUploadResp, err := protonDrive.api.RequestBlockUpload(ctx, blockUploadReq)
 		if err != nil {
 			return err
 		}
 
-		errChan := make(chan error)
-		uploadBlockWrapper := func(ctx context.Context, errChan chan error, bareURL, token string, block io.Reader) {
+		type blockUploadResult struct {
+			i   int // in pendingUploadBlocks
+			err error
+		}
+		resultChan := make(chan blockUploadResult)
+		uploadBlockWrapper := func(ctx context.Context, resultChan chan blockUploadResult, i int, bareURL, token string) {
 			// log.Println("Before semaphore")
 			if err := protonDrive.blockUploadSemaphore.Acquire(ctx, 1); err != nil {
-				errChan <- err
+				resultChan <- blockUploadResult{i: i, err: err}
+				return
 			}
 			defer protonDrive.blockUploadSemaphore.Release(1)
 			// log.Println("After semaphore")
 			// defer log.Println("Release semaphore")
 
-			errChan <- protonDrive.c.UploadBlock(ctx, bareURL, token, block)
+			err := protonDrive.api.UploadBlock(ctx, bareURL, token, bytes.NewReader(pendingUploadBlocks[i].encData))
+			if err == nil {
+				progress.BlockUploaded(pendingUploadBlocks[i].blockUploadInfo.Index, pendingUploadBlocks[i].plainSize)
+			}
+			resultChan <- blockUploadResult{i: i, err: err}
 		}
-		for i := range blockUploadResp {
-			go uploadBlockWrapper(ctx, errChan, blockUploadResp[i].BareURL, blockUploadResp[i].Token, bytes.NewReader(pendingUploadBlocks[i].encData))
+
+		// only the failed blocks are uploaded again, so a transient error doesn't throw away the rest of the batch
+		remaining := make([]int, len(blockUploadResp))
+		for i := range remaining {
+			remaining[i] = i
 		}
+		for attempt := 0; ; attempt++ {
+			for _, i := range remaining {
+				go uploadBlockWrapper(ctx, resultChan, i, blockUploadResp[i].BareURL, blockUploadResp[i].Token)
+			}
+
+			failed := make([]int, 0)
+			needNewLink := make([]int, 0)
+			var uploadErr, fatalErr error
+			for range remaining {
+				result := <-resultChan
+				if result.err == nil {
+					continue
+				}
+
+				shouldRetry, shouldRequestNewLink := classifyBlockUploadError(ctx, result.err)
+				if !shouldRetry && fatalErr == nil {
+					fatalErr = result.err
+				}
+				if uploadErr == nil {
+					uploadErr = result.err
+				}
+				failed = append(failed, result.i)
+				if shouldRequestNewLink {
+					needNewLink = append(needNewLink, result.i)
+				}
+			}
+			if len(failed) == 0 {
+				break
+			}
+			if fatalErr != nil {
+				return fatalErr
+			}
+			if attempt >= protonDrive.Config.UploadBlockRetryCount {
+				return uploadErr
+			}
+			remaining = failed
 
-		for i := 0; i < len(blockUploadResp); i++ {
-			err := <-errChan
+			log.Println("Retrying the upload of", len(remaining), "blocks after", uploadErr)
+			err = sleepWithContext(ctx, blockUploadRetryDelay(attempt))
 			if err != nil {
 				return err
 			}
+
+			if len(needNewLink) > 0 {
+				blockList := make([]proton.BlockUploadInfo, 0, len(needNewLink))
+				for _, i := range needNewLink {
+					blockList = append(blockList, pendingUploadBlocks[i].blockUploadInfo)
+				}
+				blockUploadReq.BlockList = blockList
+				newBlockUploadResp, err := protonDrive.api.RequestBlockUpload(ctx, blockUploadReq)
+				if err != nil {
+					return err
+				}
+				for j := range newBlockUploadResp {
+					blockUploadResp[needNewLink[j]] = newBlockUploadResp[j]
+				}
+			}
 		}
 
+		if journal != nil {
+			for i := range pendingUploadBlocks {
+				journal.UploadedBlocks = append(journal.UploadedBlocks, uploadJournalBlock{
+					Index:     pendingUploadBlocks[i].blockUploadInfo.Index,
+					Hash:      pendingUploadBlocks[i].blockUploadInfo.Hash,
+					PlainHMAC: pendingUploadBlocks[i].plainHMAC,
+				})
+			}
+			err = journal.write()
+			if err != nil {
+				return err
+			}
+		}
+
+		for range pendingUploadBlocks {
+			protonDrive.uploadMemoryBudget.releaseBlock()
+		}
+		clear(pendingUploadBlocks)
 		pendingUploadBlocks = pendingUploadBlocks[:0]
 
 		return nil
 	}
 
-	shouldContinue := true
-	sha1Digests := sha1.New()
-	blockSizes := make([]int64, 0)
-	for i := 1; shouldContinue; i++ {
-		if (i-1) > 0 && (i-1)%UPLOAD_BATCH_BLOCK_SIZE == 0 {
-			err := uploadPendingBlocks()
-			if err != nil {
-				return nil, 0, nil, "", err
-			}
-		}
-
-		// read at most data of size UPLOAD_BLOCK_SIZE
-		// for some reason, .Read might not actually read up to buffer size -> use io.ReadFull
-		data := make([]byte, UPLOAD_BLOCK_SIZE) // FIXME: get block size from the server config instead of hardcoding it
-		readBytes, err := io.ReadFull(file, data)
-		if err != nil {
-			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				// might still have data to read!
-				if readBytes == 0 {
-					break
+	for {
+		var result chan pendingUploadBlock
+		var ok bool
+		select {
+		case result, ok = <-encryptedBlocks:
+		default:
+			// only once all the queued blocks are pending, as they hold some of the memory too
+			waiting, waitingChanged := protonDrive.uploadMemoryBudget.waiting()
+			if waiting && len(pendingUploadBlocks) > 0 {
+				// our reader, or another upload, is waiting for the memory held by the pending blocks, don't wait for a full batch
+				err := uploadPendingBlocks()
+				if err != nil {
+					return nil, 0, nil, nil, err
 				}
-				shouldContinue = false
-			} else {
-				// all other errors
-				return nil, 0, nil, "", err
+				continue
+			}
+			select {
+			case result, ok = <-encryptedBlocks:
+			case <-waitingChanged:
+				continue
 			}
 		}
-		data = data[:readBytes]
-		totalFileSize += int64(readBytes)
-		sha1Digests.Write(data)
-		blockSizes = append(blockSizes, int64(readBytes))
-
-		// encrypt block data
-		/*
-			Encryption: current link's session key
-			Signature: share's signature address keys
-		*/
-		dataPlainMessage := crypto.NewPlainMessage(data)
-		encData, err := newSessionKey.Encrypt(dataPlainMessage)
-		if err != nil {
-			return nil, 0, nil, "", err
+		if !ok {
+			break
 		}
 
-		encSignature, err := protonDrive.DefaultAddrKR.SignDetachedEncrypted(dataPlainMessage, newNodeKR)
-		if err != nil {
-			return nil, 0, nil, "", err
-		}
-		encSignatureStr, err := encSignature.GetArmored()
-		if err != nil {
-			return nil, 0, nil, "", err
+		block := <-result
+		if block.err != nil {
+			if block.memoryReserved {
+				protonDrive.uploadMemoryBudget.releaseBlock()
+			}
+			return nil, 0, nil, nil, block.err
 		}
 
-		h := sha256.New()
-		h.Write(encData)
-		hash := h.Sum(nil)
-		base64Hash := base64.StdEncoding.EncodeToString(hash)
-		if err != nil {
-			return nil, 0, nil, "", err
+		manifestSignatureData = append(manifestSignatureData, block.hash...)
+		if block.uploaded {
+			progress.BlockUploaded(block.blockUploadInfo.Index, block.plainSize)
+			continue
 		}
-		manifestSignatureData = append(manifestSignatureData, hash...)
-
-		pendingUploadBlocks = append(pendingUploadBlocks, PendingUploadBlocks{
-			blockUploadInfo: proton.BlockUploadInfo{
-				Index:        i, // iOS drive: BE starts with 1
-				Size:         int64(len(encData)),
-				EncSignature: encSignatureStr,
-				Hash:         base64Hash,
-			},
-			encData: encData,
-		})
+		pendingUploadBlocks = append(pendingUploadBlocks, block)
+		if len(pendingUploadBlocks) == UPLOAD_BATCH_BLOCK_SIZE {
+			err := uploadPendingBlocks()
+			if err != nil {
+				return nil, 0, nil, nil, err
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		// the reader stopped early
+		return nil, 0, nil, nil, err
 	}
 	err := uploadPendingBlocks()
 	if err != nil {
-		return nil, 0, nil, "", err
+		return nil, 0, nil, nil, err
 	}
 
 	sha1Hash := sha1Digests.Sum(nil)
-	sha1String := hex.EncodeToString(sha1Hash)
-	return manifestSignatureData, totalFileSize, blockSizes, sha1String, nil
+	digests := map[string]string{
+		"SHA1": hex.EncodeToString(sha1Hash),
+	}
+	if sha256Digests != nil {
+		digests["SHA256"] = hex.EncodeToString(sha256Digests.Sum(nil))
+	}
+	return manifestSignatureData, totalFileSize, blockSizes, digests, nil
 }
 
-func (protonDrive *ProtonDrive) commitNewRevision(ctx context.Context, nodeKR *crypto.KeyRing, xAttrCommon *proton.RevisionXAttrCommon, manifestSignatureData []byte, linkID, revisionID string) error {
+// creationTime is optional, it's left out of the xattr if zero
+func newRevisionXAttrCommon(modTime, creationTime time.Time, fileSize int64, blockSizes []int64, digests map[string]string) *revisionXAttrCommon {
+	xAttrCommon := &revisionXAttrCommon{
+		RevisionXAttrCommon: proton.RevisionXAttrCommon{
+			ModificationTime: modTime.Format(XATTR_TIME_FORMAT), /* ISO8601 */
+			Size:             fileSize,
+			BlockSizes:       blockSizes,
+			Digests:          digests,
+		},
+	}
+	if !creationTime.IsZero() {
+		xAttrCommon.CreationTime = creationTime.Format(XATTR_TIME_FORMAT)
+	}
+
+	return xAttrCommon
+}
+
+func (protonDrive *ProtonDrive) commitNewRevision(ctx context.Context, nodeKR *crypto.KeyRing, xAttrCommon *revisionXAttrCommon, manifestSignatureData []byte, linkID, revisionID string) error {
 	manifestSignature, err := protonDrive.DefaultAddrKR.SignDetached(crypto.NewPlainMessage(manifestSignatureData))
 	if err != nil {
 		return err
@@ -400,15 +789,16 @@ func (protonDrive *ProtonDrive) commitNewRevision(ctx context.Context, nodeKR *c
 		SignatureAddress:  protonDrive.signatureAddress,
 	}
 
-	err = commitRevisionReq.SetEncXAttrString(protonDrive.DefaultAddrKR, nodeKR, xAttrCommon)
+	commitRevisionReq.XAttr, err = encryptRevisionXAttr(protonDrive.DefaultAddrKR, nodeKR, xAttrCommon)
 	if err != nil {
 		return err
 	}
 
-	err = protonDrive.c.CommitRevision(ctx, protonDrive.MainShare.ShareID, linkID, revisionID, commitRevisionReq)
+	err = protonDrive.api.CommitRevision(ctx, protonDrive.MainShare.ShareID, linkID, revisionID, commitRevisionReq)
 	if err != nil {
 		return err
 	}
+	protonDrive.ownRevisionDrafts.Delete(revisionID)
 
 	return nil
 }
@@ -417,57 +807,91 @@ func (protonDrive *ProtonDrive) commitNewRevision(ctx context.Context, nodeKR *c
 // 0 = normal mode
 // 1 = up to create revision
 // 2 = up to block upload
-func (protonDrive *ProtonDrive) uploadFile(ctx context.Context, parentLink *proton.Link, filename string, modTime time.Time, file io.Reader, testParam int) (string, *proton.RevisionXAttrCommon, error) {
-	// TODO: if we should use github.com/gabriel-vasile/mimetype to detect the MIME type from the file content itself
-	// Note: this approach might cause the upload progress to display the "fake" progress, since we read in all the content all-at-once
-	// mimetype.SetLimit(0)
-	// mType := mimetype.Detect(fileContent)
-	// mimeType := mType.String()
+func (protonDrive *ProtonDrive) uploadFile(ctx context.Context, parentLink *proton.Link, filename string, modTime time.Time, file io.Reader, opts *UploadOptions, testParam int) (string, string, *proton.RevisionXAttrCommon, error) {
+	givenName := filename
+	filename, err := protonDrive.validateName(filename)
+	if err != nil {
+		return "", "", nil, err
+	}
 
-	// detect MIME type by looking at the filename only
-	mimeType := mime.TypeByExtension(filepath.Ext(filename))
-	if mimeType == "" {
-		// api requires a mime type passed in
-		mimeType = "text/plain"
+	// api requires a mime type passed in
+	var mimeType string
+	if opts != nil && opts.MIMEType != "" {
+		mimeType = opts.MIMEType
+	} else {
+		mimeType, file, err = detectMIMEType(filename, file)
+		if err != nil {
+			return "", "", nil, err
+		}
 	}
 
+	var creationTime time.Time
+	var progress ProgressReporter
+	conflictPolicy := ConflictPolicyDefault
+	if opts != nil {
+		creationTime = opts.CreationTime
+		progress = opts.ProgressReporter
+		conflictPolicy = opts.ConflictPolicy
+	}
+	progress = progressReporterOrNop(progress)
+
 	/* step 1: create a draft */
-	linkID, revisionID, newSessionKey, newNodeKR, err := protonDrive.createFileUploadDraft(ctx, parentLink, filename, modTime, mimeType)
+	linkID, revisionID, name, newSessionKey, newNodeKR, err := protonDrive.createFileUploadDraft(ctx, parentLink, givenName, filename, modTime, mimeType, conflictPolicy)
 	if err != nil {
-		return "", nil, err
+		return "", "", nil, err
+	}
+
+	journal, err := protonDrive.newUploadJournal(ctx, parentLink.LinkID, filename, modTime, creationTime, linkID, revisionID, newSessionKey)
+	if err != nil {
+		return "", "", nil, err
 	}
 
 	if testParam == 1 {
-		return "", nil, nil
+		return "", "", nil, nil
 	}
 
+	xAttrCommon, err := protonDrive.uploadIntoDraft(ctx, linkID, revisionID, newSessionKey, newNodeKR, journal, file, modTime, creationTime, progress, testParam)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if testParam == 2 {
+		return "", "", nil, nil
+	}
+
+	return linkID, name, &xAttrCommon.RevisionXAttrCommon, nil
+}
+
+// uploadIntoDraft is the step 2 and 3 of an upload, shared by the new files and the new revisions
+// testParam is the same as for uploadFile, nil is returned for the xattr if the revision isn't committed
+func (protonDrive *ProtonDrive) uploadIntoDraft(ctx context.Context, linkID, revisionID string, newSessionKey *crypto.SessionKey, newNodeKR *crypto.KeyRing, journal *uploadJournal, file io.Reader, modTime, creationTime time.Time, progress ProgressReporter, testParam int) (*revisionXAttrCommon, error) {
 	/* step 2: upload blocks and collect block data */
-	manifestSignature, fileSize, blockSizes, digests, err := protonDrive.uploadAndCollectBlockData(ctx, newSessionKey, newNodeKR, file, linkID, revisionID)
+	manifestSignature, fileSize, blockSizes, digests, err := protonDrive.uploadAndCollectBlockData(ctx, newSessionKey, newNodeKR, file, linkID, revisionID, journal, progress)
 	if err != nil {
-		return "", nil, err
+		return nil, err
 	}
 
 	if testParam == 2 {
 		// for integration tests
 		// we try to simulate blocks uploaded but not yet commited
-		return "", nil, nil
+		return nil, nil
 	}
 
 	/* step 3: mark the file as active by commiting the revision */
-	xAttrCommon := &proton.RevisionXAttrCommon{
-		ModificationTime: modTime.Format("2006-01-02T15:04:05-0700"), /* ISO8601 */
-		Size:             fileSize,
-		BlockSizes:       blockSizes,
-		Digests: map[string]string{
-			"SHA1": digests,
-		},
-	}
+	xAttrCommon := newRevisionXAttrCommon(modTime, creationTime, fileSize, blockSizes, digests)
 	err = protonDrive.commitNewRevision(ctx, newNodeKR, xAttrCommon, manifestSignature, linkID, revisionID)
 	if err != nil {
-		return "", nil, err
+		return nil, err
 	}
+	progress.Committed(linkID, fileSize)
 
-	return linkID, xAttrCommon, nil
+	if journal != nil {
+		err = journal.remove()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return xAttrCommon, nil
 }
 
 func (protonDrive *ProtonDrive) UploadFileByReader(ctx context.Context, parentLinkID string, filename string, modTime time.Time, file io.Reader, testParam int) (string, *proton.RevisionXAttrCommon, error) {
@@ -476,7 +900,102 @@ func (protonDrive *ProtonDrive) UploadFileByReader(ctx context.Context, parentLi
 		return "", nil, err
 	}
 
-	return protonDrive.uploadFile(ctx, parentLink, filename, modTime, file, testParam)
+	linkID, _, xAttrCommon, err := protonDrive.uploadFile(ctx, parentLink, filename, modTime, file, nil, testParam)
+	return linkID, xAttrCommon, err
+}
+
+/*
+UploadFileWithOptions uploads file as filename into the folder parentLink, like UploadFileByPath, with the settings of opts.
+
+Unless opts sets the MIMEType, it's detected in this order
+ 1. the type sniffed from the content, if it's a specific one, e.g. image/png, so misnamed files get the right type
+ 2. the type of the filename extension
+ 3. the generic type sniffed from the content, i.e. text/plain for text, and application/octet-stream for binaries
+
+It also returns the name the file is uploaded as, which differs from filename if it's renamed by ConflictPolicyKeepBoth.
+*/
+func (protonDrive *ProtonDrive) UploadFileWithOptions(ctx context.Context, parentLink *proton.Link, filename string, modTime time.Time, file io.Reader, opts *UploadOptions) (string, string, *proton.RevisionXAttrCommon, error) {
+	return protonDrive.uploadFile(ctx, parentLink, filename, modTime, file, opts, 0)
+}
+
+/*
+UploadNewRevision uploads file as a new revision of the existing file fileLinkID.
+
+Unlike uploading by parent and name, the link is addressed directly, so the upload goes on into the same link
+even if the file is renamed or moved in the meantime, and no CreateFile round trip is wasted on the name conflict.
+The link keeps its MIME type, and the ConflictPolicy and MIMEType of opts are ignored.
+
+The revision drafts can't be tagged with the ClientUID, so a failed attempt of ours is only replaced regardless of ReplaceExistingDraft
+if it's been made by this ProtonDrive, or if its upload journal is kept in UploadJournalDir. Otherwise it's a *DraftExistsError, as for a foreign draft.
+*/
+func (protonDrive *ProtonDrive) UploadNewRevision(ctx context.Context, fileLinkID string, modTime time.Time, file io.Reader, opts *UploadOptions) (*proton.RevisionXAttrCommon, error) {
+	/* It's like event system, we need to get the latest information before creating the move request! */
+	protonDrive.removeLinkIDFromCache(fileLinkID, false)
+
+	link, err := protonDrive.getLink(ctx, fileLinkID)
+	if err != nil {
+		return nil, err
+	}
+	if link.Type != proton.LinkTypeFile {
+		return nil, ErrLinkTypeMustToBeFileType
+	}
+	if link.State != proton.LinkStateActive {
+		return nil, ErrLinkMustBeActive
+	}
+
+	var creationTime time.Time
+	var progress ProgressReporter
+	if opts != nil {
+		creationTime = opts.CreationTime
+		progress = opts.ProgressReporter
+	}
+	progress = progressReporterOrNop(progress)
+
+	// get original sessionKey and nodeKR for the current link
+	parentNodeKR, err := protonDrive.getLinkKRByID(ctx, link.ParentLinkID)
+	if err != nil {
+		return nil, err
+	}
+	signatureVerificationKR, err := protonDrive.getSignatureVerificationKeyring([]string{link.SignatureEmail})
+	if err != nil {
+		return nil, err
+	}
+	nodeKR, err := link.GetKeyRing(parentNodeKR, signatureVerificationKR)
+	if err != nil {
+		return nil, err
+	}
+	sessionKey, err := link.GetSessionKey(nodeKR)
+	if err != nil {
+		return nil, err
+	}
+
+	// the upload journal is looked up by parent and name, as for ResumeUpload
+	signatureVerificationKR, err = protonDrive.getSignatureVerificationKeyring([]string{link.NameSignatureEmail, link.SignatureEmail})
+	if err != nil {
+		return nil, err
+	}
+	filename, err := link.GetName(parentNodeKR, signatureVerificationKR)
+	if err != nil {
+		return nil, err
+	}
+
+	/* step 1: create a draft revision, the link being active, it's never deleted and recreated */
+	revisionID, _, err := protonDrive.handleRevisionConflict(ctx, link, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	journal, err := protonDrive.newUploadJournal(ctx, link.ParentLinkID, filename, modTime, creationTime, link.LinkID, revisionID, sessionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	xAttrCommon, err := protonDrive.uploadIntoDraft(ctx, link.LinkID, revisionID, sessionKey, nodeKR, journal, file, modTime, creationTime, progress, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &xAttrCommon.RevisionXAttrCommon, nil
 }
 
 func (protonDrive *ProtonDrive) UploadFileByPath(ctx context.Context, parentLink *proton.Link, filename string, filePath string, testParam int) (string, *proton.RevisionXAttrCommon, error) {
@@ -493,19 +1012,6 @@ func (protonDrive *ProtonDrive) UploadFileByPath(ctx context.Context, parentLink
 
 	in := bufio.NewReader(f)
 
-	return protonDrive.uploadFile(ctx, parentLink, filename, info.ModTime(), in, testParam)
+	linkID, _, xAttrCommon, err := protonDrive.uploadFile(ctx, parentLink, filename, info.ModTime(), in, nil, testParam)
+	return linkID, xAttrCommon, err
 }
-
-/*
-There is a route that proton-go-api doesn't have - checkAvailableHashes.
-This is used to quickly find the next available filename when the originally supplied filename is taken in the current folder.
-
-Based on the code below, which is taken from the Proton iOS Drive app, we can infer that:
-- when a file is to be uploaded && there is filename conflict after the first upload:
-	- on web, user will be prompted with a) overwrite b) keep both by appending filename with iteration number c) do nothing
-- on the iOS client logic, we can see that when the filename conflict happens (after the upload attampt failed)
-	- the filename will be hashed by using filename + iteration
-	- 10 iterations will be done per batch, each iteration's hash will be sent to the server
-	- the server will return available hashes, and the client will take the lowest iteration as the filename to be used
-	- will be used to search for the next available filename (using hashes avoids the filename being known to the server)
-*/
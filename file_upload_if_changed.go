@@ -0,0 +1,122 @@
+package proton_api_bridge
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-proton-api"
+)
+
+// UploadStatus tells what UploadFileIfChanged has done
+type UploadStatus int
+
+const (
+	UploadStatusFailed       UploadStatus = iota // returned with every error, even if the upload got as far as creating a draft
+	UploadStatusUploaded                         // the file is new or its content has changed, and it's been uploaded
+	UploadStatusUnchanged                        // the same content and modification time are on the server already, nothing is uploaded
+	UploadStatusModTimeStale                     // the same content is on the server already, nothing is uploaded, but the modification time there differs
+)
+
+/*
+UploadFileIfChanged uploads file like UploadFileWithOptions, unless filename already exists in the folder with the same content,
+i.e. the size and SHA1 recorded in the active revision match file. The existing file is then left as is, without even creating a draft,
+and the xattr of the active revision is returned.
+
+The size is checked first, so file is only read twice when the sizes match, once for the SHA1 and once for the upload.
+
+The xattr of a committed revision can't be changed, so the modification time on the server can only be updated by uploading
+the whole file again as a new revision. This is never done here: if the modification time is all that differs,
+UploadStatusModTimeStale is returned, and it's up to the caller to upload the file anyway, e.g. with UploadFileWithOptions.
+*/
+func (protonDrive *ProtonDrive) UploadFileIfChanged(ctx context.Context, parentLink *proton.Link, filename string, modTime time.Time, file io.ReadSeeker, opts *UploadOptions) (string, string, *proton.RevisionXAttrCommon, UploadStatus, error) {
+	// look for the name the file would be uploaded with
+	givenName := filename
+	filename, err := protonDrive.validateName(filename)
+	if err != nil {
+		return "", "", nil, UploadStatusFailed, err
+	}
+	searchName := filename
+	if NormalizeName(givenName) == filename {
+		// the name as given is looked up too, an older file might have it, see createFileUploadDraft
+		searchName = givenName
+	}
+
+	link, err := protonDrive.SearchByNameInActiveFolder(ctx, parentLink, searchName, true, false, proton.LinkStateActive)
+	if err != nil {
+		return "", "", nil, UploadStatusFailed, err
+	}
+
+	if link != nil {
+		xAttrCommon, err := protonDrive.getActiveRevisionXAttrCommon(ctx, link)
+		if err != nil {
+			return "", "", nil, UploadStatusFailed, err
+		}
+
+		if xAttrCommon != nil {
+			fileSystemAttrs, err := newFileSystemAttrs(xAttrCommon)
+			if err != nil {
+				return "", "", nil, UploadStatusFailed, err
+			}
+
+			unchanged, err := isFileUnchanged(fileSystemAttrs, file)
+			if err != nil {
+				return "", "", nil, UploadStatusFailed, err
+			}
+			if unchanged {
+				status := UploadStatusUnchanged
+				if !isSameModTime(fileSystemAttrs.ModificationTime, modTime) {
+					status = UploadStatusModTimeStale
+				}
+				return link.LinkID, filename, &xAttrCommon.RevisionXAttrCommon, status, nil
+			}
+		}
+	}
+
+	linkID, name, xAttrCommon, err := protonDrive.uploadFile(ctx, parentLink, givenName, modTime, file, opts, 0)
+	if err != nil {
+		return "", "", nil, UploadStatusFailed, err
+	}
+
+	return linkID, name, xAttrCommon, UploadStatusUploaded, nil
+}
+
+// isFileUnchanged compares the content of file with the attrs of the active revision, and rewinds file afterwards
+func isFileUnchanged(fileSystemAttrs *FileSystemAttrs, file io.ReadSeeker) (bool, error) {
+	if fileSystemAttrs.Digests == "" {
+		// nothing to compare with, uploaded by a client which doesn't record the SHA1
+		return false, nil
+	}
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+	if size != fileSystemAttrs.Size {
+		return false, nil
+	}
+
+	sha1Digests := sha1.New()
+	_, err = io.Copy(sha1Digests, file)
+	if err != nil {
+		return false, err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+
+	return hex.EncodeToString(sha1Digests.Sum(nil)) == strings.ToLower(fileSystemAttrs.Digests), nil
+}
+
+// the official clients only record the modification time to the second
+func isSameModTime(remoteModTime, localModTime time.Time) bool {
+	return remoteModTime.Equal(localModTime) || remoteModTime.Equal(localModTime.Truncate(time.Second))
+}
@@ -0,0 +1,79 @@
+package proton_api_bridge
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/henrybear327/Proton-API-Bridge/common"
+)
+
+func TestIsFileUnchanged(t *testing.T) {
+	content := "fileContent"
+	sha1Hash := sha1.Sum([]byte(content))
+	modTime := time.Date(2023, 7, 1, 12, 30, 15, 0, time.UTC)
+
+	testCases := []struct {
+		name     string
+		attrs    FileSystemAttrs
+		content  string
+		expected bool
+	}{
+		{"same content", FileSystemAttrs{Size: int64(len(content)), Digests: hex.EncodeToString(sha1Hash[:]), ModificationTime: modTime}, content, true},
+		{"uppercase digest", FileSystemAttrs{Size: int64(len(content)), Digests: strings.ToUpper(hex.EncodeToString(sha1Hash[:])), ModificationTime: modTime}, content, true},
+		{"different size", FileSystemAttrs{Size: int64(len(content)), Digests: hex.EncodeToString(sha1Hash[:]), ModificationTime: modTime}, content + "!", false},
+		{"different content", FileSystemAttrs{Size: int64(len(content)), Digests: hex.EncodeToString(sha1Hash[:]), ModificationTime: modTime}, "fileContenT", false},
+		{"no digest", FileSystemAttrs{Size: int64(len(content)), ModificationTime: modTime}, content, false},
+	}
+
+	for _, tc := range testCases {
+		file := strings.NewReader(tc.content)
+		unchanged, err := isFileUnchanged(&tc.attrs, file)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+		if unchanged != tc.expected {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.expected, unchanged)
+		}
+
+		// the file must be rewound for the upload
+		if position, _ := file.Seek(0, io.SeekCurrent); position != 0 {
+			t.Errorf("%v: expected the file to be rewound, at %v", tc.name, position)
+		}
+	}
+}
+
+func TestIsSameModTime(t *testing.T) {
+	modTime := time.Date(2023, 7, 1, 12, 30, 15, 0, time.UTC)
+
+	testCases := []struct {
+		name      string
+		localTime time.Time
+		expected  bool
+	}{
+		{"same", modTime, true},
+		{"to the second", modTime.Add(123 * time.Millisecond), true},
+		{"different", modTime.Add(time.Hour), false},
+	}
+
+	for _, tc := range testCases {
+		if same := isSameModTime(modTime, tc.localTime); same != tc.expected {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.expected, same)
+		}
+	}
+}
+
+func TestUploadFileIfChangedFailedStatus(t *testing.T) {
+	protonDrive := &ProtonDrive{Config: &common.Config{}}
+
+	_, _, _, status, err := protonDrive.UploadFileIfChanged(context.Background(), &proton.Link{}, "a/b", time.Now(), strings.NewReader(""), nil)
+	if !errors.Is(err, ErrNameContainsSlash) || status != UploadStatusFailed {
+		t.Fatalf("expected ErrNameContainsSlash with UploadStatusFailed, got %v with %v", err, status)
+	}
+}
@@ -0,0 +1,338 @@
+package proton_api_bridge
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+)
+
+/*
+When UploadJournalDir is set, every upload keeps a journal of the draft it's uploading into, and of the blocks the server has accepted.
+If the upload dies before the revision is committed, ResumeUpload picks the draft up again and only uploads the missing blocks.
+
+The journal holds no key material. The session key stays on the server, encrypted with the node key, as the content key packet of the link,
+and is derived again on resume. The journal only keeps a fingerprint of it, to make sure the blocks are encrypted with the same key.
+
+The journal doesn't leak the name or the content of the file either. The name is kept as its hash in the parent folder, as the server has it,
+and the plaintext of the blocks as an HMAC keyed with the session key, so nothing can be guessed from them without the keys.
+
+The journals are named after the draft, so 2 uploads never share one. The journals of the same name in the same folder are dropped when a new upload
+of it starts, and the ones which haven't been written to for UPLOAD_JOURNAL_MAX_AGE are dropped as abandoned.
+*/
+
+// the drafts this old are not worth resuming anymore, if the server still has them at all
+var UPLOAD_JOURNAL_MAX_AGE = 7 * 24 * time.Hour
+
+type uploadJournalBlock struct {
+	Index     int
+	Hash      string // base64 sha256 of the encrypted block, as sent to the server, for the manifest signature
+	PlainHMAC string // base64 HMAC-SHA256 of the plaintext keyed with the session key, to make sure the source hasn't changed since
+}
+
+type uploadJournal struct {
+	ParentLinkID          string
+	NameHash              string // the hash of the name in the parent folder, as the server computes it
+	ModTime               time.Time
+	CreationTime          time.Time
+	LinkID                string
+	RevisionID            string
+	SessionKeyFingerprint string
+	BlockSize             int
+	UploadedBlocks        []uploadJournalBlock
+
+	path string
+}
+
+func uploadJournalPath(journalDir, linkID, revisionID string) string {
+	key := sha256.Sum256([]byte(linkID + "/" + revisionID))
+	return filepath.Join(journalDir, hex.EncodeToString(key[:])+".json")
+}
+
+func sessionKeyFingerprint(sessionKey *crypto.SessionKey) string {
+	fingerprint := sha256.Sum256(sessionKey.Key)
+	return hex.EncodeToString(fingerprint[:])
+}
+
+func readUploadJournal(journalPath string) (*uploadJournal, error) {
+	data, err := os.ReadFile(journalPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var journal uploadJournal
+	err = json.Unmarshal(data, &journal)
+	if err != nil {
+		// a corrupted journal is as good as no journal
+		return nil, nil
+	}
+	journal.path = journalPath
+
+	return &journal, nil
+}
+
+// findUploadJournal returns the journal of the upload of one of nameHashes into parentLinkID, nil if there's none
+func findUploadJournal(journalDir, parentLinkID string, nameHashes []string) (*uploadJournal, error) {
+	return scanUploadJournals(journalDir, parentLinkID, nameHashes, false)
+}
+
+// removeUploadJournals drops the journals of the uploads of nameHashes into parentLinkID
+func removeUploadJournals(journalDir, parentLinkID string, nameHashes []string) error {
+	_, err := scanUploadJournals(journalDir, parentLinkID, nameHashes, true)
+	return err
+}
+
+// scanUploadJournals drops the abandoned journals along the way, whatever they are looked up for
+func scanUploadJournals(journalDir, parentLinkID string, nameHashes []string, remove bool) (*uploadJournal, error) {
+	entries, err := os.ReadDir(journalDir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var found *uploadJournal
+	for _, entry := range entries {
+		if entry.IsDir() || !(strings.HasSuffix(entry.Name(), ".json") || strings.HasSuffix(entry.Name(), ".json.tmp")) {
+			continue
+		}
+		journalPath := filepath.Join(journalDir, entry.Name())
+
+		info, err := entry.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		abandoned := time.Since(info.ModTime()) > UPLOAD_JOURNAL_MAX_AGE
+
+		var journal *uploadJournal
+		if !abandoned && strings.HasSuffix(entry.Name(), ".json") {
+			journal, err = readUploadJournal(journalPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+		matches := journal != nil && journal.ParentLinkID == parentLinkID && slices.Contains(nameHashes, journal.NameHash)
+
+		if abandoned || (remove && matches) {
+			err = os.Remove(journalPath)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+		} else if matches && found == nil {
+			found = journal
+		}
+	}
+
+	return found, nil
+}
+
+// getNameHashes returns the hashes of name in the folder parentLinkID, as given and normalized, see ValidateName
+func (protonDrive *ProtonDrive) getNameHashes(ctx context.Context, parentLinkID, name string) ([]string, error) {
+	parentLink, err := protonDrive.getLink(ctx, parentLinkID)
+	if err != nil {
+		return nil, err
+	}
+	parentNodeKR, err := protonDrive.getLinkKR(ctx, parentLink)
+	if err != nil {
+		return nil, err
+	}
+	signatureVerificationKR, err := protonDrive.getSignatureVerificationKeyring([]string{parentLink.SignatureEmail}, parentNodeKR)
+	if err != nil {
+		return nil, err
+	}
+	parentHashKey, err := parentLink.GetHashKey(parentNodeKR, signatureVerificationKR)
+	if err != nil {
+		return nil, err
+	}
+
+	nameHashes := make([]string, 0, 2)
+	for _, name := range []string{name, NormalizeName(name)} {
+		nameHash, err := proton.GetNameHash(name, parentHashKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(nameHashes) == 0 || nameHashes[0] != nameHash {
+			nameHashes = append(nameHashes, nameHash)
+		}
+	}
+
+	return nameHashes, nil
+}
+
+func (journal *uploadJournal) write() error {
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+
+	// write and rename, so a crash never leaves a half-written journal behind
+	err = os.WriteFile(journal.path+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(journal.path+".tmp", journal.path)
+}
+
+func (journal *uploadJournal) remove() error {
+	err := os.Remove(journal.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// newUploadJournal returns nil if the uploads aren't journaled
+func (protonDrive *ProtonDrive) newUploadJournal(ctx context.Context, parentLinkID, filename string, modTime, creationTime time.Time, linkID, revisionID string, sessionKey *crypto.SessionKey) (*uploadJournal, error) {
+	if protonDrive.Config.UploadJournalDir == "" {
+		return nil, nil
+	}
+
+	nameHashes, err := protonDrive.getNameHashes(ctx, parentLinkID, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(protonDrive.Config.UploadJournalDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	// the previous upload of the same file won't be resumed anymore
+	err = removeUploadJournals(protonDrive.Config.UploadJournalDir, parentLinkID, nameHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	journal := &uploadJournal{
+		ParentLinkID:          parentLinkID,
+		NameHash:              nameHashes[0],
+		ModTime:               modTime,
+		CreationTime:          creationTime,
+		LinkID:                linkID,
+		RevisionID:            revisionID,
+		SessionKeyFingerprint: sessionKeyFingerprint(sessionKey),
+		BlockSize:             UPLOAD_BLOCK_SIZE,
+		UploadedBlocks:        make([]uploadJournalBlock, 0),
+
+		path: uploadJournalPath(protonDrive.Config.UploadJournalDir, linkID, revisionID),
+	}
+
+	return journal, journal.write()
+}
+
+/*
+ResumeUpload finishes an upload of filename into the folder parentLinkID which died before the revision got committed.
+
+The file must be read from the start again, as the SHA1 digest covers the whole file, but only the blocks
+the server hasn't accepted yet are encrypted and uploaded. ErrUploadSourceChanged is returned if the content
+of the already uploaded blocks doesn't match file anymore, in which case the file should be uploaded anew.
+progress is optional, BytesRead covers the whole file, but the blocks already uploaded are neither encrypted nor uploaded again.
+*/
+func (protonDrive *ProtonDrive) ResumeUpload(ctx context.Context, parentLinkID, filename string, file io.ReadSeeker, progress ProgressReporter) (string, *proton.RevisionXAttrCommon, error) {
+	if protonDrive.Config.UploadJournalDir == "" {
+		return "", nil, ErrUploadJournalDirIsEmpty
+	}
+
+	nameHashes, err := protonDrive.getNameHashes(ctx, parentLinkID, filename)
+	if err != nil {
+		return "", nil, err
+	}
+	journal, err := findUploadJournal(protonDrive.Config.UploadJournalDir, parentLinkID, nameHashes)
+	if err != nil {
+		return "", nil, err
+	}
+	if journal == nil {
+		return "", nil, ErrUploadJournalNotFound
+	}
+	if journal.BlockSize != UPLOAD_BLOCK_SIZE {
+		return "", nil, ErrUploadJournalMismatch
+	}
+
+	/* It's like event system, we need to get the latest information before creating the move request! */
+	protonDrive.removeLinkIDFromCache(journal.LinkID, false)
+
+	link, err := protonDrive.getLink(ctx, journal.LinkID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	draftRevisions, err := protonDrive.GetRevisions(ctx, link, proton.RevisionStateDraft)
+	if err != nil {
+		return "", nil, err
+	}
+	foundDraftRevision := false
+	for i := range draftRevisions {
+		if draftRevisions[i].ID == journal.RevisionID {
+			foundDraftRevision = true
+		}
+	}
+	if !foundDraftRevision {
+		// the draft has been committed, replaced, or deleted in the meantime, nothing left to resume
+		err = journal.remove()
+		if err != nil {
+			return "", nil, err
+		}
+		return "", nil, ErrUploadJournalStale
+	}
+
+	// get original sessionKey and nodeKR for the current link
+	parentNodeKR, err := protonDrive.getLinkKRByID(ctx, link.ParentLinkID)
+	if err != nil {
+		return "", nil, err
+	}
+	signatureVerificationKR, err := protonDrive.getSignatureVerificationKeyring([]string{link.SignatureEmail})
+	if err != nil {
+		return "", nil, err
+	}
+	nodeKR, err := link.GetKeyRing(parentNodeKR, signatureVerificationKR)
+	if err != nil {
+		return "", nil, err
+	}
+	sessionKey, err := link.GetSessionKey(nodeKR)
+	if err != nil {
+		return "", nil, err
+	}
+	if sessionKeyFingerprint(sessionKey) != journal.SessionKeyFingerprint {
+		return "", nil, ErrUploadJournalMismatch
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", nil, err
+	}
+
+	progress = progressReporterOrNop(progress)
+	manifestSignature, fileSize, blockSizes, digests, err := protonDrive.uploadAndCollectBlockData(ctx, sessionKey, nodeKR, file, link.LinkID, journal.RevisionID, journal, progress)
+	if err != nil {
+		return "", nil, err
+	}
+
+	xAttrCommon := newRevisionXAttrCommon(journal.ModTime, journal.CreationTime, fileSize, blockSizes, digests)
+	err = protonDrive.commitNewRevision(ctx, nodeKR, xAttrCommon, manifestSignature, link.LinkID, journal.RevisionID)
+	if err != nil {
+		return "", nil, err
+	}
+	progress.Committed(link.LinkID, fileSize)
+
+	return link.LinkID, &xAttrCommon.RevisionXAttrCommon, journal.remove()
+}
@@ -0,0 +1,68 @@
+package proton_api_bridge
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUploadJournalLookupAndCleanup(t *testing.T) {
+	journalDir := t.TempDir()
+
+	writeJournal := func(parentLinkID, nameHash, linkID, revisionID string) *uploadJournal {
+		journal := &uploadJournal{
+			ParentLinkID: parentLinkID,
+			NameHash:     nameHash,
+			LinkID:       linkID,
+			RevisionID:   revisionID,
+			path:         uploadJournalPath(journalDir, linkID, revisionID),
+		}
+		if err := journal.write(); err != nil {
+			t.Fatal(err)
+		}
+		return journal
+	}
+
+	writeJournal("parent", "nameHash", "link", "revision")
+	writeJournal("parent", "otherNameHash", "otherLink", "revision")
+	writeJournal("otherParent", "nameHash", "link", "otherRevision")
+	abandoned := writeJournal("parent", "abandonedNameHash", "abandonedLink", "revision")
+	oldTime := time.Now().Add(-UPLOAD_JOURNAL_MAX_AGE - time.Hour)
+	if err := os.Chtimes(abandoned.path, oldTime, oldTime); err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 drafts of the same link never share a journal
+	journal, err := findUploadJournal(journalDir, "otherParent", []string{"nameHash"})
+	if err != nil || journal == nil || journal.RevisionID != "otherRevision" {
+		t.Fatalf("expected the journal of otherRevision, got %#v %v", journal, err)
+	}
+
+	// the normalized name hash is looked up too
+	journal, err = findUploadJournal(journalDir, "parent", []string{"nfdNameHash", "nameHash"})
+	if err != nil || journal == nil || journal.LinkID != "link" || journal.RevisionID != "revision" {
+		t.Fatalf("expected the journal of link, got %#v %v", journal, err)
+	}
+
+	if _, err := os.Stat(abandoned.path); !os.IsNotExist(err) {
+		t.Fatalf("expected the abandoned journal to be removed, got %v", err)
+	}
+
+	err = removeUploadJournals(journalDir, "parent", []string{"nameHash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal, err = findUploadJournal(journalDir, "parent", []string{"nameHash"})
+	if err != nil || journal != nil {
+		t.Fatalf("expected no journal, got %#v %v", journal, err)
+	}
+
+	entries, err := filepath.Glob(filepath.Join(journalDir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected the journals of otherLink and otherRevision to be kept, got %v", entries)
+	}
+}
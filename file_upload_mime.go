@@ -0,0 +1,72 @@
+package proton_api_bridge
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// http.DetectContentType considers at most the first 512 bytes
+const MIME_SNIFF_SIZE = 512
+
+// the content sniffer returns these for any binary or zip based format, so a known extension is more precise
+var genericSniffedMIMETypes = map[string]bool{
+	"application/octet-stream": true,
+	"application/zip":          true,
+}
+
+// the text formats missing from the table of mime.TypeByExtension, which the sniffer would otherwise report as text/plain or text/html
+var textExtensionMIMETypes = map[string]string{
+	".md":       "text/markdown",
+	".markdown": "text/markdown",
+}
+
+// the sniffer tells text types apart by the first bytes only, e.g. any text starting with "<p" or "<!--" is text/html
+func isGenericSniffedMIMEType(mimeType string) bool {
+	return genericSniffedMIMETypes[mimeType] || strings.HasPrefix(mimeType, "text/")
+}
+
+/*
+detectMIMEType peeks at the beginning of file, and returns the MIME type together with a reader which still yields the whole content.
+
+The MIME type is picked in this order
+ 1. the type sniffed from the content, if it's a specific one, e.g. image/png, so misnamed files get the right type
+ 2. the type of the filename extension
+ 3. the generic or text type sniffed from the content, e.g. text/plain, text/html, or application/octet-stream for binaries
+*/
+func detectMIMEType(filename string, file io.Reader) (string, io.Reader, error) {
+	// returns file itself if it's already a large enough bufio.Reader
+	bufferedFile := bufio.NewReaderSize(file, MIME_SNIFF_SIZE)
+	head, err := bufferedFile.Peek(MIME_SNIFF_SIZE)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return "", nil, err
+	}
+
+	sniffedMIMEType := withoutMIMETypeParams(http.DetectContentType(head))
+	if !isGenericSniffedMIMEType(sniffedMIMEType) {
+		return sniffedMIMEType, bufferedFile, nil
+	}
+
+	extension := filepath.Ext(filename)
+	if extensionMIMEType := withoutMIMETypeParams(mime.TypeByExtension(extension)); extensionMIMEType != "" {
+		return extensionMIMEType, bufferedFile, nil
+	}
+	if extensionMIMEType, ok := textExtensionMIMETypes[strings.ToLower(extension)]; ok {
+		return extensionMIMEType, bufferedFile, nil
+	}
+
+	return sniffedMIMEType, bufferedFile, nil
+}
+
+// e.g. "text/plain; charset=utf-8" -> "text/plain"
+func withoutMIMETypeParams(mimeType string) string {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return ""
+	}
+
+	return mediaType
+}
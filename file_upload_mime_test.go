@@ -0,0 +1,46 @@
+package proton_api_bridge
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDetectMIMEType(t *testing.T) {
+	pngHeader := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 600)
+
+	for _, tc := range []struct {
+		filename string
+		content  string
+		expected string
+	}{
+		{"image.png", pngHeader, "image/png"},
+		{"misnamed.txt", pngHeader, "image/png"},                       // specific sniffed type wins over the extension
+		{"noextension", pngHeader, "image/png"},                        // no extension needed
+		{"data.json", `{"a": 1}`, "application/json"},                  // generic sniffed type loses to the extension
+		{"README.md", "<p align=\"center\">logo</p>", "text/markdown"}, // sniffed as text/html
+		{"icon.svg", "<!-- comment --><svg></svg>", "image/svg+xml"},   // sniffed as text/html
+		{"config.xml", "<div>not html</div>", "text/xml"},              // sniffed as text/html
+		{"page", "<!DOCTYPE html><html></html>", "text/html"},          // no extension to tell otherwise
+		{"notes", "just some text", "text/plain"},
+		{"binary", "\x00\x01\x02\x03", "application/octet-stream"},
+		{"empty", "", "text/plain"},
+	} {
+		mimeType, reader, err := detectMIMEType(tc.filename, strings.NewReader(tc.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mimeType != tc.expected {
+			t.Fatalf("%v: expected %v, got %v", tc.filename, tc.expected, mimeType)
+		}
+
+		// peeking must not consume the content
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != tc.content {
+			t.Fatalf("%v: the content has been altered by the detection", tc.filename)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package proton_api_bridge
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ProtonMail/go-proton-api"
+)
+
+const (
+	UPLOAD_BLOCK_RETRY_BASE_DELAY = 1 * time.Second
+	UPLOAD_BLOCK_RETRY_MAX_DELAY  = 30 * time.Second
+)
+
+/*
+classifyBlockUploadError tells if the block upload is worth another attempt, and if so, whether it needs a new upload link.
+
+The upload links handed out by RequestBlockUpload are short-lived tokens for a storage node,
+which are rejected once expired, so these are asked for again, while the server errors and network errors are retried as they are.
+Anything else, e.g. a block rejected as too large, fails the same way on every attempt.
+*/
+func classifyBlockUploadError(ctx context.Context, err error) (bool, bool) {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false, false
+	}
+
+	var apiErr *proton.APIError
+	if !errors.As(err, &apiErr) {
+		// the connection to the storage node failed
+		return true, false
+	}
+
+	switch {
+	case apiErr.Status == http.StatusUnauthorized,
+		apiErr.Status == http.StatusForbidden,
+		apiErr.Status == http.StatusNotFound,
+		apiErr.Status == http.StatusGone,
+		apiErr.Status == http.StatusUnprocessableEntity:
+		return true, true
+	case apiErr.Status == http.StatusTooManyRequests,
+		apiErr.Status >= http.StatusInternalServerError:
+		return true, false
+	default:
+		return false, false
+	}
+}
+
+// blockUploadRetryDelay doubles the delay with every attempt, starting from 0
+func blockUploadRetryDelay(attempt int) time.Duration {
+	delay := UPLOAD_BLOCK_RETRY_BASE_DELAY
+	for i := 0; i < attempt && delay < UPLOAD_BLOCK_RETRY_MAX_DELAY; i++ {
+		delay *= 2
+	}
+
+	return min(delay, UPLOAD_BLOCK_RETRY_MAX_DELAY)
+}
+
+func sleepWithContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
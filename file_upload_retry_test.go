@@ -0,0 +1,53 @@
+package proton_api_bridge
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-proton-api"
+)
+
+func TestClassifyBlockUploadError(t *testing.T) {
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	testCases := []struct {
+		name                 string
+		ctx                  context.Context
+		err                  error
+		shouldRetry          bool
+		shouldRequestNewLink bool
+	}{
+		{"network error", context.Background(), io.ErrUnexpectedEOF, true, false},
+		{"expired token", context.Background(), &proton.APIError{Status: http.StatusUnprocessableEntity}, true, true},
+		{"rejected token", context.Background(), fmt.Errorf("upload: %w", &proton.APIError{Status: http.StatusForbidden}), true, true},
+		{"rate limited", context.Background(), &proton.APIError{Status: http.StatusTooManyRequests}, true, false},
+		{"storage node error", context.Background(), &proton.APIError{Status: http.StatusBadGateway}, true, false},
+		{"bad request", context.Background(), &proton.APIError{Status: http.StatusBadRequest}, false, false},
+		{"canceled", canceledCtx, io.ErrUnexpectedEOF, false, false},
+		{"deadline", context.Background(), context.DeadlineExceeded, false, false},
+	}
+
+	for _, tc := range testCases {
+		shouldRetry, shouldRequestNewLink := classifyBlockUploadError(tc.ctx, tc.err)
+		if shouldRetry != tc.shouldRetry || shouldRequestNewLink != tc.shouldRequestNewLink {
+			t.Errorf("%v: expected %v %v, got %v %v", tc.name, tc.shouldRetry, tc.shouldRequestNewLink, shouldRetry, shouldRequestNewLink)
+		}
+	}
+}
+
+func TestBlockUploadRetryDelay(t *testing.T) {
+	expected := []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second}
+	for attempt := range expected {
+		if delay := blockUploadRetryDelay(attempt); delay != expected[attempt] {
+			t.Errorf("attempt %v: expected %v, got %v", attempt, expected[attempt], delay)
+		}
+	}
+	if delay := blockUploadRetryDelay(1000); delay != UPLOAD_BLOCK_RETRY_MAX_DELAY {
+		t.Errorf("expected the delay to be capped at %v, got %v", UPLOAD_BLOCK_RETRY_MAX_DELAY, delay)
+	}
+}
@@ -0,0 +1,194 @@
+package proton_api_bridge
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/henrybear327/Proton-API-Bridge/common"
+	"golang.org/x/sync/semaphore"
+)
+
+// fakeUploadAPI accepts all the blocks, and records what has been requested and uploaded
+type fakeUploadAPI struct {
+	fakeDriveAPI
+
+	locker         sync.Mutex
+	batches        [][]int        // the block indices of each RequestBlockUpload
+	uploadedBlocks map[string]int // upload count by bare URL, which is the block index
+	committed      bool
+}
+
+func newTestUploadDrive(t *testing.T) (*ProtonDrive, *fakeUploadAPI) {
+	api := &fakeUploadAPI{uploadedBlocks: make(map[string]int)}
+	api.requestBlockUpload = func(ctx context.Context, req proton.BlockUploadReq) ([]proton.BlockUploadLink, error) {
+		api.locker.Lock()
+		defer api.locker.Unlock()
+		links := make([]proton.BlockUploadLink, 0, len(req.BlockList))
+		batch := make([]int, 0, len(req.BlockList))
+		for _, block := range req.BlockList {
+			links = append(links, proton.BlockUploadLink{BareURL: strconv.Itoa(block.Index)})
+			batch = append(batch, block.Index)
+		}
+		api.batches = append(api.batches, batch)
+		return links, nil
+	}
+	api.uploadBlock = func(ctx context.Context, bareURL, token string, block io.Reader) error {
+		api.locker.Lock()
+		defer api.locker.Unlock()
+		api.uploadedBlocks[bareURL]++
+		return nil
+	}
+	api.commitRevision = func(ctx context.Context, shareID, linkID, revisionID string, req proton.CommitRevisionReq) error {
+		api.locker.Lock()
+		defer api.locker.Unlock()
+		api.committed = true
+		return nil
+	}
+
+	return &ProtonDrive{
+		MainShare:            &proton.Share{},
+		DefaultAddrKR:        newTestKeyRing(t),
+		Config:               &common.Config{},
+		api:                  api,
+		blockUploadSemaphore: semaphore.NewWeighted(2),
+		blockCryptoSemaphore: semaphore.NewWeighted(2),
+	}, api
+}
+
+func TestEncryptBlockRoundTrip(t *testing.T) {
+	protonDrive := &ProtonDrive{
+		DefaultAddrKR:        newTestKeyRing(t),
+		blockCryptoSemaphore: semaphore.NewWeighted(1),
+	}
+	nodeKR := newTestKeyRing(t)
+	sessionKey, err := crypto.GenerateSessionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	block := protonDrive.encryptBlock(context.Background(), sessionKey, nodeKR, 3, data)
+	if block.err != nil {
+		t.Fatal(block.err)
+	}
+	if block.blockUploadInfo.Index != 3 || block.blockUploadInfo.Size != int64(len(block.encData)) {
+		t.Fatalf("unexpected block upload info %#v", block.blockUploadInfo)
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	err = decryptBlockIntoBuffer(sessionKey, protonDrive.DefaultAddrKR, nodeKR, block.blockUploadInfo.Hash, block.blockUploadInfo.EncSignature, buffer, bytes.NewReader(block.encData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buffer.Bytes(), data) {
+		t.Fatalf("decrypted content is different from the original content")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := protonDrive.blockCryptoSemaphore.Acquire(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	defer protonDrive.blockCryptoSemaphore.Release(1)
+	if block := protonDrive.encryptBlock(ctx, sessionKey, nodeKR, 1, data); block.err != context.Canceled {
+		t.Fatalf("expected context.Canceled while waiting for the semaphore, got %v", block.err)
+	}
+}
+
+func TestIsOwnRevisionDraft(t *testing.T) {
+	protonDrive := &ProtonDrive{
+		Config: &common.Config{UploadJournalDir: t.TempDir()},
+	}
+
+	protonDrive.ownRevisionDrafts.Store("created", struct{}{})
+	journal := &uploadJournal{path: uploadJournalPath(protonDrive.Config.UploadJournalDir, "link", "journaled")}
+	if err := journal.write(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		linkID, revisionID string
+		expected           bool
+	}{
+		{"link", "created", true},
+		{"link", "journaled", true},
+		{"otherLink", "journaled", false},
+		{"link", "foreign", false},
+	} {
+		if isOwn := protonDrive.isOwnRevisionDraft(tc.linkID, tc.revisionID); isOwn != tc.expected {
+			t.Errorf("%v/%v: expected %v, got %v", tc.linkID, tc.revisionID, tc.expected, isOwn)
+		}
+	}
+}
+
+// slowReader gives the uploader the time to drain the blocks read so far
+type slowReader struct {
+	r io.Reader
+}
+
+func (r slowReader) Read(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return r.r.Read(p)
+}
+
+func TestUploadBatchesWithMemoryBudget(t *testing.T) {
+	ORIGINAL_UPLOAD_BLOCK_SIZE := UPLOAD_BLOCK_SIZE
+	defer func() {
+		UPLOAD_BLOCK_SIZE = ORIGINAL_UPLOAD_BLOCK_SIZE
+	}()
+	UPLOAD_BLOCK_SIZE = 10
+
+	blockCount := 2*UPLOAD_BATCH_BLOCK_SIZE + 4
+	content := strings.Repeat("0123456789", blockCount)
+
+	for _, tc := range []struct {
+		name         string
+		budgetBlocks int
+	}{
+		// the reader never waits, so the batches are full
+		{"budget larger than the file", 2 * blockCount},
+		// the reader waits for the pending blocks all the time, so the batches are flushed early
+		{"budget smaller than a batch", 3},
+	} {
+		protonDrive, api := newTestUploadDrive(t)
+		protonDrive.uploadMemoryBudget = newMemoryBudget(int64(tc.budgetBlocks * UPLOAD_BLOCK_SIZE))
+		nodeKR := newTestKeyRing(t)
+		sessionKey, err := crypto.GenerateSessionKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_, err = protonDrive.uploadIntoDraft(ctx, "linkID", "revisionID", sessionKey, nodeKR, nil, slowReader{strings.NewReader(content)}, time.Now(), time.Time{}, NopProgressReporter{}, 0)
+		cancel()
+		if err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+
+		if len(api.uploadedBlocks) != blockCount {
+			t.Fatalf("%v: expected %v blocks uploaded, got %v", tc.name, blockCount, len(api.uploadedBlocks))
+		}
+		expectedBatches := (blockCount + UPLOAD_BATCH_BLOCK_SIZE - 1) / UPLOAD_BATCH_BLOCK_SIZE
+		if tc.budgetBlocks >= blockCount && len(api.batches) != expectedBatches {
+			t.Fatalf("%v: expected %v RequestBlockUpload calls, got %v", tc.name, expectedBatches, api.batches)
+		}
+		for _, batch := range api.batches {
+			if len(batch) > min(tc.budgetBlocks, UPLOAD_BATCH_BLOCK_SIZE) {
+				t.Fatalf("%v: expected batches of at most %v blocks, got %v", tc.name, min(tc.budgetBlocks, UPLOAD_BATCH_BLOCK_SIZE), api.batches)
+			}
+		}
+
+		// all the memory is given back
+		if !protonDrive.uploadMemoryBudget.semaphore.TryAcquire(int64(tc.budgetBlocks * UPLOAD_BLOCK_SIZE)) {
+			t.Fatalf("%v: expected the whole budget to be released", tc.name)
+		}
+	}
+}
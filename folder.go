@@ -81,14 +81,29 @@ func (protonDrive *ProtonDrive) CreateNewFolderByID(ctx context.Context, parentL
 }
 
 func (protonDrive *ProtonDrive) CreateNewFolder(ctx context.Context, parentLink *proton.Link, folderName string) (string, error) {
+	linkID, _, err := protonDrive.CreateNewFolderWithConflictPolicy(ctx, parentLink, folderName, ConflictPolicyFail)
+	return linkID, err
+}
+
+// CreateNewFolderWithConflictPolicy also returns the name the folder is created with, which differs from folderName if it's renamed by ConflictPolicyKeepBoth
+func (protonDrive *ProtonDrive) CreateNewFolderWithConflictPolicy(ctx context.Context, parentLink *proton.Link, folderName string, conflictPolicy ConflictPolicy) (string, string, error) {
+	if conflictPolicy == ConflictPolicyOverwrite {
+		return "", "", ErrInvalidConflictPolicy
+	}
+
+	folderName, err := protonDrive.validateName(folderName)
+	if err != nil {
+		return "", "", err
+	}
+
 	parentNodeKR, err := protonDrive.getLinkKR(ctx, parentLink)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	newNodeKey, newNodePassphraseEnc, newNodePassphraseSignature, err := generateNodeKeys(parentNodeKR, protonDrive.DefaultAddrKR)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	createFolderReq := proton.CreateFolderReq{
@@ -106,43 +121,59 @@ func (protonDrive *ProtonDrive) CreateNewFolder(ctx context.Context, parentLink
 		SignatureAddress: protonDrive.signatureAddress,
 	}
 
-	/* Name is encrypted using the parent's keyring, and signed with address key */
-	err = createFolderReq.SetName(folderName, protonDrive.DefaultAddrKR, parentNodeKR)
-	if err != nil {
-		return "", err
-	}
-
 	signatureVerificationKR, err := protonDrive.getSignatureVerificationKeyring([]string{parentLink.SignatureEmail}, parentNodeKR)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	parentHashKey, err := parentLink.GetHashKey(parentNodeKR, signatureVerificationKR)
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+
+	name := folderName
+	setNameAndHash := func() error {
+		/* Name is encrypted using the parent's keyring, and signed with address key */
+		err := createFolderReq.SetName(name, protonDrive.DefaultAddrKR, parentNodeKR)
+		if err != nil {
+			return err
+		}
+
+		return createFolderReq.SetHash(name, parentHashKey)
 	}
-	err = createFolderReq.SetHash(folderName, parentHashKey)
+	err = setNameAndHash()
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	newNodeKR, err := getKeyRing(parentNodeKR, protonDrive.DefaultAddrKR, newNodeKey, newNodePassphraseEnc, newNodePassphraseSignature)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	err = createFolderReq.SetNodeHashKey(newNodeKR)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	// FIXME: check for duplicated filename by relying on checkAvailableHashes
 	// if the folder name already exist, this call will return an error
 	createFolderResp, err := protonDrive.c.CreateFolder(ctx, protonDrive.MainShare.ShareID, createFolderReq)
+	for attempt := 0; isNameConflictError(err) && conflictPolicy == ConflictPolicyKeepBoth && attempt < NAME_CONFLICT_RETRY_COUNT; attempt++ {
+		name, err = protonDrive.findAvailableName(ctx, parentLink, parentHashKey, folderName, false)
+		if err != nil {
+			return "", "", err
+		}
+		err = setNameAndHash()
+		if err != nil {
+			return "", "", err
+		}
+
+		createFolderResp, err = protonDrive.c.CreateFolder(ctx, protonDrive.MainShare.ShareID, createFolderReq)
+	}
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	// log.Printf("createFolderResp %#v", createFolderResp)
 
-	return createFolderResp.ID, nil
+	return createFolderResp.ID, name, nil
 }
 
 func (protonDrive *ProtonDrive) MoveFileByID(ctx context.Context, srcLinkID, dstParentLinkID string, dstName string) error {
@@ -169,7 +200,13 @@ func (protonDrive *ProtonDrive) MoveFileByID(ctx context.Context, srcLinkID, dst
 }
 
 func (protonDrive *ProtonDrive) MoveFile(ctx context.Context, srcLink *proton.Link, dstParentLink *proton.Link, dstName string) error {
-	return protonDrive.moveLink(ctx, srcLink, dstParentLink, dstName)
+	_, err := protonDrive.moveLink(ctx, srcLink, dstParentLink, dstName, ConflictPolicyFail)
+	return err
+}
+
+// MoveFileWithConflictPolicy returns the name the file is moved to, which differs from dstName if it's renamed by ConflictPolicyKeepBoth
+func (protonDrive *ProtonDrive) MoveFileWithConflictPolicy(ctx context.Context, srcLink *proton.Link, dstParentLink *proton.Link, dstName string, conflictPolicy ConflictPolicy) (string, error) {
+	return protonDrive.moveLink(ctx, srcLink, dstParentLink, dstName, conflictPolicy)
 }
 
 func (protonDrive *ProtonDrive) MoveFolderByID(ctx context.Context, srcLinkID, dstParentLinkID, dstName string) error {
@@ -196,10 +233,41 @@ func (protonDrive *ProtonDrive) MoveFolderByID(ctx context.Context, srcLinkID, d
 }
 
 func (protonDrive *ProtonDrive) MoveFolder(ctx context.Context, srcLink *proton.Link, dstParentLink *proton.Link, dstName string) error {
-	return protonDrive.moveLink(ctx, srcLink, dstParentLink, dstName)
+	_, err := protonDrive.moveLink(ctx, srcLink, dstParentLink, dstName, ConflictPolicyFail)
+	return err
+}
+
+// MoveFolderWithConflictPolicy returns the name the folder is moved to, which differs from dstName if it's renamed by ConflictPolicyKeepBoth
+func (protonDrive *ProtonDrive) MoveFolderWithConflictPolicy(ctx context.Context, srcLink *proton.Link, dstParentLink *proton.Link, dstName string, conflictPolicy ConflictPolicy) (string, error) {
+	return protonDrive.moveLink(ctx, srcLink, dstParentLink, dstName, conflictPolicy)
 }
 
-func (protonDrive *ProtonDrive) moveLink(ctx context.Context, srcLink *proton.Link, dstParentLink *proton.Link, dstName string) error {
+func (protonDrive *ProtonDrive) moveLink(ctx context.Context, srcLink *proton.Link, dstParentLink *proton.Link, dstName string, conflictPolicy ConflictPolicy) (string, error) {
+	if conflictPolicy == ConflictPolicyOverwrite {
+		return "", ErrInvalidConflictPolicy
+	}
+
+	srcParentKR, err := protonDrive.getLinkKRByID(ctx, srcLink.ParentLinkID)
+	if err != nil {
+		return "", err
+	}
+
+	// an existing name might not be valid anymore, e.g. with a trailing space, which mustn't prevent moving the link without renaming it
+	srcSignatureVerificationKR, err := protonDrive.getSignatureVerificationKeyring([]string{srcLink.NameSignatureEmail, srcLink.SignatureEmail})
+	if err != nil {
+		return "", err
+	}
+	srcName, err := srcLink.GetName(srcParentKR, srcSignatureVerificationKR)
+	if err != nil {
+		return "", err
+	}
+	if dstName != srcName {
+		dstName, err = protonDrive.validateName(dstName)
+		if err != nil {
+			return "", err
+		}
+	}
+
 	// we are moving the srcLink to under dstParentLink, with name dstName
 	req := proton.MoveLinkReq{
 		ParentLinkID:     dstParentLink.LinkID,
@@ -209,34 +277,35 @@ func (protonDrive *ProtonDrive) moveLink(ctx context.Context, srcLink *proton.Li
 
 	dstParentKR, err := protonDrive.getLinkKR(ctx, dstParentLink)
 	if err != nil {
-		return err
-	}
-
-	err = req.SetName(dstName, protonDrive.DefaultAddrKR, dstParentKR)
-	if err != nil {
-		return err
+		return "", err
 	}
 
 	signatureVerificationKR, err := protonDrive.getSignatureVerificationKeyring([]string{dstParentLink.SignatureEmail}, dstParentKR)
 	if err != nil {
-		return err
+		return "", err
 	}
 	dstParentHashKey, err := dstParentLink.GetHashKey(dstParentKR, signatureVerificationKR)
 	if err != nil {
-		return err
-	}
-	err = req.SetHash(dstName, dstParentHashKey)
-	if err != nil {
-		return err
+		return "", err
 	}
 
-	srcParentKR, err := protonDrive.getLinkKRByID(ctx, srcLink.ParentLinkID)
+	name := dstName
+	setNameAndHash := func() error {
+		err := req.SetName(name, protonDrive.DefaultAddrKR, dstParentKR)
+		if err != nil {
+			return err
+		}
+
+		return req.SetHash(name, dstParentHashKey)
+	}
+	err = setNameAndHash()
 	if err != nil {
-		return err
+		return "", err
 	}
+
 	nodePassphrase, err := reencryptKeyPacket(srcParentKR, dstParentKR, protonDrive.DefaultAddrKR, srcLink.NodePassphrase)
 	if err != nil {
-		return err
+		return "", err
 	}
 	req.NodePassphrase = nodePassphrase
 	req.NodePassphraseSignature = srcLink.NodePassphraseSignature
@@ -247,11 +316,23 @@ func (protonDrive *ProtonDrive) moveLink(ctx context.Context, srcLink *proton.Li
 	// because there might be the case where others read for the same link currently being move -> race condition
 	// argument: cache itself is already outdated in a sense, as we don't even have event system (even if we have, it's still outdated...)
 	err = protonDrive.c.MoveLink(ctx, protonDrive.MainShare.ShareID, srcLink.LinkID, req)
+	for attempt := 0; isNameConflictError(err) && conflictPolicy == ConflictPolicyKeepBoth && attempt < NAME_CONFLICT_RETRY_COUNT; attempt++ {
+		name, err = protonDrive.findAvailableName(ctx, dstParentLink, dstParentHashKey, dstName, srcLink.Type == proton.LinkTypeFile)
+		if err != nil {
+			return "", err
+		}
+		err = setNameAndHash()
+		if err != nil {
+			return "", err
+		}
+
+		err = protonDrive.c.MoveLink(ctx, protonDrive.MainShare.ShareID, srcLink.LinkID, req)
+	}
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	time.Sleep(5 * time.Second)
 
-	return nil
+	return name, nil
 }
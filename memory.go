@@ -0,0 +1,142 @@
+package proton_api_bridge
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+)
+
+/*
+The blocks are the bulk of the memory used by the transfers, so they are what's accounted for.
+
+The buffers are pooled process-wide, and are shared by the uploads (for the plaintext being read and encrypted)
+and the downloads (for the plaintext being decrypted and read).
+
+When Config.MemoryBudget is set, it's split in half between the uploads and the downloads of the ProtonDrive.
+Every block held in memory by a transfer takes one block worth of its half, from the time it's read or fetched,
+until it's uploaded or consumed. Once a half is exhausted, the transfers wait for each other.
+The budget is approximate, as it doesn't cover the short-lived copies made by the encryption, the block an upload is reading
+before it reserves the budget for it, nor the blocks decrypted by ReadAt while the download budget is exhausted.
+The downloads decrypt the blocks as they arrive, so the encrypted blocks are never held in full.
+
+A download is often the source of an upload, e.g. when copying between 2 folders, so to never deadlock
+ - the uploads and the downloads don't share the budget, so they never wait for each other's blocks
+ - an upload only reserves the budget for a block once it's read, so it holds none of it while waiting for its source
+ - the uploads send the blocks collected for a batch as soon as a transfer waits for the budget, so their blocks are always released
+ - a download only waits for the budget while not holding any of it, and takes what's left of the budget otherwise, e.g. for read-ahead,
+   so it waits at most for the blocks of the other downloads to be consumed
+*/
+
+var blockBufferPool = sync.Pool{
+	New: func() interface{} {
+		return bytes.NewBuffer(make([]byte, 0, UPLOAD_BLOCK_SIZE))
+	},
+}
+
+func getBlockBuffer() *bytes.Buffer {
+	return blockBufferPool.Get().(*bytes.Buffer)
+}
+
+func putBlockBuffer(buffer *bytes.Buffer) {
+	buffer.Reset()
+	blockBufferPool.Put(buffer)
+}
+
+// getUploadBlockBuffer returns a pooled buffer, and a slice of it of UPLOAD_BLOCK_SIZE to read a block into
+func getUploadBlockBuffer() (*bytes.Buffer, []byte) {
+	buffer := getBlockBuffer()
+	buffer.Grow(UPLOAD_BLOCK_SIZE)
+
+	return buffer, buffer.AvailableBuffer()[:UPLOAD_BLOCK_SIZE]
+}
+
+type memoryBudget struct {
+	semaphore *semaphore.Weighted
+	size      int64
+
+	waitersLocker  sync.Mutex
+	waiters        int
+	waitersChanged chan struct{} // closed and replaced whenever a transfer starts waiting
+}
+
+// newMemoryBudget returns nil if size is 0, i.e. the memory isn't limited
+func newMemoryBudget(size int64) *memoryBudget {
+	if size <= 0 {
+		return nil
+	}
+
+	return &memoryBudget{
+		semaphore:      semaphore.NewWeighted(size),
+		size:           size,
+		waitersChanged: make(chan struct{}),
+	}
+}
+
+// newMemoryBudgets splits size between the uploads and the downloads
+func newMemoryBudgets(size int64) (*memoryBudget, *memoryBudget) {
+	if size <= 0 {
+		return nil, nil
+	}
+
+	uploadSize := max(size/2, 1)
+	return newMemoryBudget(uploadSize), newMemoryBudget(max(size-uploadSize, 1))
+}
+
+// a budget smaller than a block still lets one block through at a time
+func (budget *memoryBudget) blockCost() int64 {
+	return min(int64(UPLOAD_BLOCK_SIZE), budget.size)
+}
+
+func (budget *memoryBudget) reserveBlock(ctx context.Context) error {
+	if budget == nil {
+		return nil
+	}
+	if budget.semaphore.TryAcquire(budget.blockCost()) {
+		return nil
+	}
+
+	budget.addWaiter(1)
+	defer budget.addWaiter(-1)
+	return budget.semaphore.Acquire(ctx, budget.blockCost())
+}
+
+func (budget *memoryBudget) addWaiter(delta int) {
+	budget.waitersLocker.Lock()
+	defer budget.waitersLocker.Unlock()
+
+	budget.waiters += delta
+	if delta > 0 {
+		close(budget.waitersChanged)
+		budget.waitersChanged = make(chan struct{})
+	}
+}
+
+// waiting tells whether a transfer is waiting for the budget, and returns a channel which is closed once another one starts waiting
+func (budget *memoryBudget) waiting() (bool, <-chan struct{}) {
+	if budget == nil {
+		// never closed, as nobody ever waits
+		return false, nil
+	}
+
+	budget.waitersLocker.Lock()
+	defer budget.waitersLocker.Unlock()
+	return budget.waiters > 0, budget.waitersChanged
+}
+
+func (budget *memoryBudget) tryReserveBlock() bool {
+	if budget == nil {
+		return true
+	}
+
+	return budget.semaphore.TryAcquire(budget.blockCost())
+}
+
+func (budget *memoryBudget) releaseBlock() {
+	if budget == nil {
+		return
+	}
+
+	budget.semaphore.Release(budget.blockCost())
+}
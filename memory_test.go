@@ -0,0 +1,210 @@
+package proton_api_bridge
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+)
+
+func TestMemoryBudgetUnlimited(t *testing.T) {
+	budget := newMemoryBudget(0)
+	if budget != nil {
+		t.Fatalf("expected no budget")
+	}
+
+	for i := 0; i < 100; i++ {
+		if err := budget.reserveBlock(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if !budget.tryReserveBlock() {
+			t.Fatalf("expected an unlimited budget")
+		}
+	}
+	budget.releaseBlock()
+}
+
+func TestMemoryBudgetBackpressure(t *testing.T) {
+	budget := newMemoryBudget(2 * int64(UPLOAD_BLOCK_SIZE))
+
+	if err := budget.reserveBlock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !budget.tryReserveBlock() {
+		t.Fatalf("expected a second block to fit")
+	}
+	if budget.tryReserveBlock() {
+		t.Fatalf("expected the budget to be exhausted")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := budget.reserveBlock(ctx); err == nil {
+		t.Fatalf("expected to wait for the budget")
+	}
+
+	reserved := make(chan error)
+	go func() {
+		reserved <- budget.reserveBlock(context.Background())
+	}()
+	budget.releaseBlock()
+	if err := <-reserved; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryBudgetSmallerThanABlock(t *testing.T) {
+	budget := newMemoryBudget(1024)
+
+	if err := budget.reserveBlock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if budget.tryReserveBlock() {
+		t.Fatalf("expected one block at a time")
+	}
+	budget.releaseBlock()
+	if !budget.tryReserveBlock() {
+		t.Fatalf("expected the block to be released")
+	}
+}
+
+func TestGetUploadBlockBuffer(t *testing.T) {
+	buffer, data := getUploadBlockBuffer()
+	defer putBlockBuffer(buffer)
+
+	if len(data) != UPLOAD_BLOCK_SIZE {
+		t.Fatalf("expected %v bytes, got %v", UPLOAD_BLOCK_SIZE, len(data))
+	}
+	if buffer.Len() != 0 {
+		t.Fatalf("expected the buffer to be empty, got %v bytes", buffer.Len())
+	}
+}
+
+func TestMemoryBudgetWaiting(t *testing.T) {
+	budget := newMemoryBudget(int64(UPLOAD_BLOCK_SIZE))
+	if err := budget.reserveBlock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	waiting, waitingChanged := budget.waiting()
+	if waiting {
+		t.Fatalf("expected nobody to wait yet")
+	}
+
+	reserved := make(chan error)
+	go func() {
+		reserved <- budget.reserveBlock(context.Background())
+	}()
+	select {
+	case <-waitingChanged:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected to be told about the waiting transfer")
+	}
+	if waiting, _ := budget.waiting(); !waiting {
+		t.Fatalf("expected a transfer to wait")
+	}
+
+	budget.releaseBlock()
+	if err := <-reserved; err != nil {
+		t.Fatal(err)
+	}
+	if waiting, _ := budget.waiting(); waiting {
+		t.Fatalf("expected nobody to wait anymore")
+	}
+}
+
+// a download piped into an upload of the same drive, e.g. a copy between 2 folders, must not wait for its own upload's memory
+func TestMemoryBudgetDownloadPipedIntoUpload(t *testing.T) {
+	ORIGINAL_UPLOAD_BLOCK_SIZE := UPLOAD_BLOCK_SIZE
+	defer func() {
+		UPLOAD_BLOCK_SIZE = ORIGINAL_UPLOAD_BLOCK_SIZE
+	}()
+	UPLOAD_BLOCK_SIZE = 10
+
+	// the download blocks don't line up with the upload blocks
+	blocks := make([][]byte, 0)
+	for i := 0; i < 3*UPLOAD_BATCH_BLOCK_SIZE; i++ {
+		blocks = append(blocks, []byte(fmt.Sprintf("block %03d,", i)[:7]))
+	}
+
+	for _, tc := range []struct {
+		budgetBlocks, pipes, readAhead int
+	}{
+		{1, 1, 0},
+		{2, 2, 0},
+		{4, 4, 0},
+		{4, 4, 2},
+		{8, 8, 0},
+	} {
+		protonDrive, api := newTestUploadDrive(t)
+		protonDrive.uploadMemoryBudget, protonDrive.downloadMemoryBudget = newMemoryBudgets(int64(tc.budgetBlocks * UPLOAD_BLOCK_SIZE))
+		protonDrive.addrKRs = make(map[string]*crypto.KeyRing)
+		protonDrive.addrData = make(map[string]proton.Address)
+
+		// the BareURL of a block is "pipe/position"
+		encBlocks := make([][][]byte, tc.pipes)
+		api.getBlock = func(ctx context.Context, bareURL, token string) (io.ReadCloser, error) {
+			var pipe, i int
+			if _, err := fmt.Sscanf(bareURL, "%d/%d", &pipe, &i); err != nil {
+				return nil, err
+			}
+			return io.NopCloser(bytes.NewReader(encBlocks[pipe][i])), nil
+		}
+
+		readers := make([]*FileDownloadReader, 0, tc.pipes)
+		for pipe := 0; pipe < tc.pipes; pipe++ {
+			reader, readerEncBlocks := newTestReadAheadReader(t, &api.fakeDriveAPI, tc.readAhead, blocks...)
+			encBlocks[pipe] = readerEncBlocks
+			for i := range reader.revision.Blocks {
+				reader.revision.Blocks[i].BareURL = fmt.Sprintf("%d/%d", pipe, i)
+			}
+			// one drive does both, each reader's blocks are signed with a different address key
+			addressID, email := "addressID"+strconv.Itoa(pipe), fmt.Sprintf("user%d@proton.me", pipe)
+			protonDrive.addrKRs[addressID] = reader.protonDrive.DefaultAddrKR
+			protonDrive.addrData[email] = proton.Address{ID: addressID, Email: email}
+			reader.link.SignatureEmail = email
+			reader.protonDrive = protonDrive
+			readers = append(readers, reader)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errChan := make(chan error, tc.pipes)
+		for pipe, reader := range readers {
+			nodeKR := newTestKeyRing(t)
+			sessionKey, err := crypto.GenerateSessionKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			go func(linkID string, reader *FileDownloadReader) {
+				defer reader.Close()
+				_, err := protonDrive.uploadIntoDraft(ctx, linkID, "revisionID", sessionKey, nodeKR, nil, reader, time.Now(), time.Time{}, NopProgressReporter{}, 0)
+				errChan <- err
+			}("linkID"+strconv.Itoa(pipe), reader)
+		}
+
+		for i := 0; i < tc.pipes; i++ {
+			select {
+			case err := <-errChan:
+				if err != nil {
+					t.Fatalf("%+v: %v", tc, err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("%+v: the uploads are deadlocked with their downloads", tc)
+			}
+		}
+		cancel()
+
+		for _, budget := range []*memoryBudget{protonDrive.uploadMemoryBudget, protonDrive.downloadMemoryBudget} {
+			if !budget.semaphore.TryAcquire(budget.size) {
+				t.Fatalf("%+v: expected the whole budget to be released", tc)
+			}
+		}
+	}
+}
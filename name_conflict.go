@@ -0,0 +1,104 @@
+package proton_api_bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/ProtonMail/go-proton-api"
+)
+
+/*
+The web client asks what to do when the name is already taken in the folder: a) overwrite b) keep both c) do nothing.
+
+For keep both, the Proton iOS Drive app looks for the next free name like this
+  - the name is hashed with each iteration appended, e.g. "report (1).pdf", "report (2).pdf", ...
+  - 10 iterations are done per batch, and the hashes of the batch are sent to checkAvailableHashes at once
+  - the server returns the available hashes, and the client takes the lowest iteration as the name to be used
+  - using hashes avoids the names being known to the server
+
+The names of the drafts being uploaded are reported as pending, not as available, so they're skipped too.
+*/
+
+type ConflictPolicy int
+
+const (
+	ConflictPolicyDefault   ConflictPolicy = iota // uploads add a revision to the existing file, folder creation and moves fail
+	ConflictPolicyOverwrite                       // uploads only, same as the default
+	ConflictPolicyFail                            // uploads fail with proton.ErrFileNameExist too
+	ConflictPolicyKeepBoth                        // the lowest free iteration is appended to the name, e.g. "report (2).pdf"
+)
+
+const (
+	NAME_CONFLICT_BATCH_SIZE     = 10
+	NAME_CONFLICT_MAX_ITERATIONS = 1000
+
+	// the free name can be taken by someone else between the check and the creation
+	NAME_CONFLICT_RETRY_COUNT = 3
+
+	// "A file or folder with that name already exists"
+	NAME_CONFLICT_API_ERROR_CODE = 2500
+)
+
+// nameWithIteration inserts the iteration before the extension of a file, the same way as the official clients
+func nameWithIteration(name string, iteration int, isFile bool) string {
+	if iteration == 0 {
+		return name
+	}
+
+	ext := ""
+	if isFile {
+		ext = path.Ext(name)
+		if ext == name {
+			// dotfiles, e.g. ".bashrc", have no extension
+			ext = ""
+		}
+	}
+
+	return fmt.Sprintf("%v (%v)%v", strings.TrimSuffix(name, ext), iteration, ext)
+}
+
+// findAvailableName returns the lowest iteration of name which is free in the folder parentLink, starting with name itself
+func (protonDrive *ProtonDrive) findAvailableName(ctx context.Context, parentLink *proton.Link, parentHashKey []byte, name string, isFile bool) (string, error) {
+	for first := 0; first < NAME_CONFLICT_MAX_ITERATIONS; first += NAME_CONFLICT_BATCH_SIZE {
+		hashes := make([]string, 0, NAME_CONFLICT_BATCH_SIZE)
+		for iteration := first; iteration < first+NAME_CONFLICT_BATCH_SIZE; iteration++ {
+			hash, err := proton.GetNameHash(nameWithIteration(name, iteration, isFile), parentHashKey)
+			if err != nil {
+				return "", err
+			}
+			hashes = append(hashes, hash)
+		}
+
+		res, err := protonDrive.c.CheckAvailableHashes(ctx, protonDrive.MainShare.ShareID, parentLink.LinkID, proton.CheckAvailableHashesReq{
+			Hashes: hashes,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		availableHashes := make(map[string]bool, len(res.AvailableHashes))
+		for _, hash := range res.AvailableHashes {
+			availableHashes[hash] = true
+		}
+		for i, hash := range hashes {
+			if availableHashes[hash] {
+				return nameWithIteration(name, first+i, isFile), nil
+			}
+		}
+	}
+
+	return "", ErrNoAvailableName
+}
+
+// only the file and folder creation map the conflict to an error of their own, the move returns the bare API error
+func isNameConflictError(err error) bool {
+	if errors.Is(err, proton.ErrFileNameExist) || errors.Is(err, proton.ErrFolderNameExist) {
+		return true
+	}
+
+	var apiErr *proton.APIError
+	return errors.As(err, &apiErr) && apiErr.Code == NAME_CONFLICT_API_ERROR_CODE
+}
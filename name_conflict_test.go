@@ -0,0 +1,25 @@
+package proton_api_bridge
+
+import "testing"
+
+func TestNameWithIteration(t *testing.T) {
+	testCases := []struct {
+		name      string
+		iteration int
+		isFile    bool
+		expected  string
+	}{
+		{"report.pdf", 0, true, "report.pdf"},
+		{"report.pdf", 2, true, "report (2).pdf"},
+		{"archive.tar.gz", 1, true, "archive.tar (1).gz"},
+		{"README", 1, true, "README (1)"},
+		{".bashrc", 1, true, ".bashrc (1)"},
+		{"photos.2023", 3, false, "photos.2023 (3)"},
+	}
+
+	for _, tc := range testCases {
+		if actual := nameWithIteration(tc.name, tc.iteration, tc.isFile); actual != tc.expected {
+			t.Errorf("nameWithIteration(%q, %v, %v) = %q, expected %q", tc.name, tc.iteration, tc.isFile, actual, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package proton_api_bridge
+
+import (
+	"path"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+/*
+The names are validated the same way as the web client does it, see
+https://github.com/ProtonMail/WebClients/blob/b4eba99d241af4fdae06ff7138bd651a40ef5d3c/applications/drive/src/app/store/_links/validation.ts#L51
+  - no "/" in the name
+  - at most MAX_NAME_LENGTH characters, counted in UTF-16 code units as in JavaScript
+  - no space at the end
+
+On top of that, "." and ".." are rejected, and the names are normalized to NFC.
+The server only sees the hash of the name, so "é" as one code point (NFC, e.g. Windows and Linux)
+and as "e" followed by a combining accent (NFD, e.g. older macOS) would otherwise be 2 different files which look the same.
+*/
+
+const MAX_NAME_LENGTH = 255
+
+// NormalizeName returns name in NFC, so the same name always gets the same hash
+func NormalizeName(name string) string {
+	return norm.NFC.String(name)
+}
+
+// ValidateName returns the normalized name, or an *InvalidNameError if the other clients can't handle it
+func ValidateName(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		return "", &InvalidNameError{Name: name, Reason: ErrNameInvalidUTF8}
+	}
+	name = NormalizeName(name)
+
+	switch {
+	case name == "":
+		return "", &InvalidNameError{Name: name, Reason: ErrNameEmpty}
+	case name == "." || name == "..":
+		return "", &InvalidNameError{Name: name, Reason: ErrNameReserved}
+	case strings.Contains(name, "/"):
+		return "", &InvalidNameError{Name: name, Reason: ErrNameContainsSlash}
+	case nameLength(name) > MAX_NAME_LENGTH:
+		return "", &InvalidNameError{Name: name, Reason: ErrNameTooLong}
+	case strings.HasSuffix(name, " "):
+		return "", &InvalidNameError{Name: name, Reason: ErrNameEndsWithSpace}
+	}
+
+	return name, nil
+}
+
+/*
+SanitizeName fixes what ValidateName would reject, where possible
+  - the invalid UTF-8 sequences are replaced with U+FFFD
+  - "/" is replaced with "_"
+  - the name is truncated to MAX_NAME_LENGTH, keeping the extension
+  - the trailing spaces are trimmed
+
+The empty and reserved names can't be fixed, and are still rejected.
+*/
+func SanitizeName(name string) (string, error) {
+	name = NormalizeName(strings.ToValidUTF8(name, "\uFFFD"))
+	name = strings.ReplaceAll(name, "/", "_")
+	name = strings.TrimRight(name, " ")
+
+	if nameLength(name) > MAX_NAME_LENGTH {
+		ext := path.Ext(name)
+		if ext == name || nameLength(ext) >= MAX_NAME_LENGTH {
+			ext = ""
+		}
+
+		base := []rune(strings.TrimSuffix(name, ext))
+		for len(base) > 0 && nameLength(string(base))+nameLength(ext) > MAX_NAME_LENGTH {
+			base = base[:len(base)-1]
+		}
+		name = strings.TrimRight(string(base), " ") + ext
+	}
+
+	return ValidateName(name)
+}
+
+// validateName applies Config.SanitizeNames
+func (protonDrive *ProtonDrive) validateName(name string) (string, error) {
+	if protonDrive.Config.SanitizeNames {
+		return SanitizeName(name)
+	}
+
+	return ValidateName(name)
+}
+
+// nameLength is the length of name in JavaScript
+func nameLength(name string) int {
+	return len(utf16.Encode([]rune(name)))
+}
@@ -0,0 +1,89 @@
+package proton_api_bridge
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateName(t *testing.T) {
+	testCases := []struct {
+		name     string
+		expected string
+		err      error
+	}{
+		{"fileContent.txt", "fileContent.txt", nil},
+		{" leading space", " leading space", nil},
+		{".bashrc", ".bashrc", nil},
+		{"caf\u00e9.txt", "caf\u00e9.txt", nil},
+		{"cafe\u0301.txt", "caf\u00e9.txt", nil}, // NFD to NFC
+		{strings.Repeat("a", MAX_NAME_LENGTH), strings.Repeat("a", MAX_NAME_LENGTH), nil},
+		{"", "", ErrNameEmpty},
+		{".", "", ErrNameReserved},
+		{"..", "", ErrNameReserved},
+		{"a/b", "", ErrNameContainsSlash},
+		{"trailing space ", "", ErrNameEndsWithSpace},
+		{strings.Repeat("a", MAX_NAME_LENGTH+1), "", ErrNameTooLong},
+		{strings.Repeat("😀", MAX_NAME_LENGTH/2+1), "", ErrNameTooLong}, // 2 UTF-16 code units each
+		{"invalid\xff", "", ErrNameInvalidUTF8},
+	}
+
+	for _, tc := range testCases {
+		name, err := ValidateName(tc.name)
+		if tc.err != nil {
+			var invalidNameErr *InvalidNameError
+			if !errors.Is(err, tc.err) || !errors.Is(err, ErrInvalidName) || !errors.As(err, &invalidNameErr) {
+				t.Errorf("%q: expected %v, got %v", tc.name, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.name, err)
+			continue
+		}
+		if name != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.name, tc.expected, name)
+		}
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+	testCases := []struct {
+		name     string
+		expected string
+		err      error
+	}{
+		{"fileContent.txt", "fileContent.txt", nil},
+		{"a/b.txt", "a_b.txt", nil},
+		{"trailing space  ", "trailing space", nil},
+		{"cafe\u0301", "caf\u00e9", nil},
+		{"invalid\xff", "invalid\uFFFD", nil},
+		{strings.Repeat("a", MAX_NAME_LENGTH) + ".txt", strings.Repeat("a", MAX_NAME_LENGTH-len(".txt")) + ".txt", nil},
+		{strings.Repeat("a", MAX_NAME_LENGTH-5) + "     b.txt", strings.Repeat("a", MAX_NAME_LENGTH-5) + ".txt", nil},
+		{strings.Repeat("a", MAX_NAME_LENGTH+1), strings.Repeat("a", MAX_NAME_LENGTH), nil},
+		{"   ", "", ErrNameEmpty},
+		{"..", "", ErrNameReserved},
+	}
+
+	for _, tc := range testCases {
+		name, err := SanitizeName(tc.name)
+		if tc.err != nil {
+			if !errors.Is(err, tc.err) {
+				t.Errorf("%q: expected %v, got %v", tc.name, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.name, err)
+			continue
+		}
+		if name != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.name, tc.expected, name)
+		}
+
+		// sanitizing is idempotent, and the result is always valid
+		if validated, err := ValidateName(name); err != nil || validated != name {
+			t.Errorf("%q: expected %q to be valid, got %q %v", tc.name, name, validated, err)
+		}
+	}
+}
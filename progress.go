@@ -0,0 +1,65 @@
+package proton_api_bridge
+
+import "io"
+
+/*
+ProgressReporter receives the progress of an upload or a download.
+
+The blocks are identified by their index in the revision, which starts at 1, as they are transferred concurrently and finish in any order.
+The sizes are of the plaintext, unless stated otherwise.
+
+The callbacks are called from different goroutines at the same time, and must return quickly, as they hold up the transfer.
+Embed NopProgressReporter to only implement the callbacks of interest.
+It's passed when the transfer is created, as the blocks may be prefetched right away, and nil means no reporting.
+*/
+type ProgressReporter interface {
+	// upload
+	BytesRead(n int64)                    // read from the source
+	BlockEncrypted(index int, size int64) // encrypted and signed, not called for the blocks already uploaded by a resumed upload
+	BlockUploaded(index int, size int64)  // accepted by the server
+	Committed(linkID string, size int64)  // the revision is committed, the upload is complete
+
+	// download
+	BlockFetched(index int, encSize int64) // the encrypted block is downloaded, or read from the block cache
+	BlockDecrypted(index int, size int64)  // decrypted, and its hash and signature verified
+}
+
+type NopProgressReporter struct{}
+
+func (NopProgressReporter) BytesRead(n int64)                     {}
+func (NopProgressReporter) BlockEncrypted(index int, size int64)  {}
+func (NopProgressReporter) BlockUploaded(index int, size int64)   {}
+func (NopProgressReporter) Committed(linkID string, size int64)   {}
+func (NopProgressReporter) BlockFetched(index int, encSize int64) {}
+func (NopProgressReporter) BlockDecrypted(index int, size int64)  {}
+
+// progressReporterOrNop saves the nil checks at every callback
+func progressReporterOrNop(progress ProgressReporter) ProgressReporter {
+	if progress == nil {
+		return NopProgressReporter{}
+	}
+
+	return progress
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,172 @@
+package proton_api_bridge
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"golang.org/x/sync/semaphore"
+)
+
+type recordingProgressReporter struct {
+	NopProgressReporter
+
+	locker    sync.Mutex
+	bytesRead int64
+	encrypted map[int]int64
+	uploaded  map[int]int64
+	committed map[string]int64
+	fetched   map[int]int64
+	decrypted map[int]int64
+}
+
+func (r *recordingProgressReporter) BytesRead(n int64) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	r.bytesRead += n
+}
+
+func (r *recordingProgressReporter) BlockEncrypted(index int, size int64) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	r.encrypted[index] += size
+}
+
+func (r *recordingProgressReporter) BlockUploaded(index int, size int64) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	r.uploaded[index] += size
+}
+
+func (r *recordingProgressReporter) Committed(linkID string, size int64) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	r.committed[linkID] += size
+}
+
+func (r *recordingProgressReporter) BlockFetched(index int, encSize int64) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	r.fetched[index] += encSize
+}
+
+func (r *recordingProgressReporter) BlockDecrypted(index int, size int64) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	r.decrypted[index] += size
+}
+
+func TestDownloadBlockReportsProgress(t *testing.T) {
+	addrKR := newTestKeyRing(t)
+	blockCache, err := newBlockCache(t.TempDir(), 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	protonDrive := &ProtonDrive{
+		DefaultAddrKR:        addrKR,
+		addrKRs:              map[string]*crypto.KeyRing{"addressID": addrKR},
+		addrData:             map[string]proton.Address{"user@proton.me": {ID: "addressID", Email: "user@proton.me"}},
+		blockCryptoSemaphore: semaphore.NewWeighted(1),
+		blockCache:           blockCache,
+	}
+	nodeKR := newTestKeyRing(t)
+	sessionKey, err := crypto.GenerateSessionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	encryptedBlock := protonDrive.encryptBlock(context.Background(), sessionKey, nodeKR, 2, data)
+	if encryptedBlock.err != nil {
+		t.Fatal(encryptedBlock.err)
+	}
+	// served from the cache, so no client is needed
+	blockCache.put(encryptedBlock.blockUploadInfo.Hash, encryptedBlock.encData)
+
+	progress := &recordingProgressReporter{
+		fetched:   make(map[int]int64),
+		decrypted: make(map[int]int64),
+	}
+	link := &proton.Link{SignatureEmail: "user@proton.me"}
+	block := &proton.Block{
+		Index:        2,
+		Hash:         encryptedBlock.blockUploadInfo.Hash,
+		EncSignature: encryptedBlock.blockUploadInfo.EncSignature,
+	}
+	buffer := bytes.NewBuffer(nil)
+	err = protonDrive.downloadBlock(context.Background(), link, nodeKR, sessionKey, block, buffer, progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if progress.fetched[2] != int64(len(encryptedBlock.encData)) || progress.decrypted[2] != int64(len(data)) {
+		t.Fatalf("expected block 2 fetched %v and decrypted %v, got %v and %v", len(encryptedBlock.encData), len(data), progress.fetched, progress.decrypted)
+	}
+
+	// a block failing the verification is not reported
+	progress.fetched, progress.decrypted = make(map[int]int64), make(map[int]int64)
+	block.EncSignature = ""
+	err = protonDrive.downloadBlock(context.Background(), link, nodeKR, sessionKey, block, bytes.NewBuffer(nil), progress)
+	if err == nil {
+		t.Fatalf("expected the signature verification to fail")
+	}
+	if len(progress.fetched) != 0 || len(progress.decrypted) != 0 {
+		t.Fatalf("expected nothing reported, got %v and %v", progress.fetched, progress.decrypted)
+	}
+}
+
+func TestUploadReportsProgress(t *testing.T) {
+	ORIGINAL_UPLOAD_BLOCK_SIZE := UPLOAD_BLOCK_SIZE
+	defer func() {
+		UPLOAD_BLOCK_SIZE = ORIGINAL_UPLOAD_BLOCK_SIZE
+	}()
+	UPLOAD_BLOCK_SIZE = 10
+
+	protonDrive, api := newTestUploadDrive(t)
+	nodeKR := newTestKeyRing(t)
+	sessionKey, err := crypto.GenerateSessionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 full batches, and a last block shorter than the others
+	content := strings.Repeat("0123456789", 2*UPLOAD_BATCH_BLOCK_SIZE) + "01234"
+	progress := &recordingProgressReporter{
+		encrypted: make(map[int]int64),
+		uploaded:  make(map[int]int64),
+		committed: make(map[string]int64),
+	}
+	_, err = protonDrive.uploadIntoDraft(context.Background(), "linkID", "revisionID", sessionKey, nodeKR, nil, strings.NewReader(content), time.Now(), time.Time{}, progress, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !api.committed {
+		t.Fatalf("expected the revision to be committed")
+	}
+
+	blockCount := 2*UPLOAD_BATCH_BLOCK_SIZE + 1
+	if progress.bytesRead != int64(len(content)) {
+		t.Fatalf("expected %v bytes read, got %v", len(content), progress.bytesRead)
+	}
+	if len(progress.encrypted) != blockCount || len(progress.uploaded) != blockCount || len(api.uploadedBlocks) != blockCount {
+		t.Fatalf("expected %v blocks encrypted and uploaded, got %v and %v", blockCount, progress.encrypted, progress.uploaded)
+	}
+	for index := 1; index <= blockCount; index++ {
+		size := int64(UPLOAD_BLOCK_SIZE)
+		if index == blockCount {
+			size = 5
+		}
+		if progress.encrypted[index] != size || progress.uploaded[index] != size || api.uploadedBlocks[strconv.Itoa(index)] != 1 {
+			t.Fatalf("block %v: expected %v bytes encrypted and uploaded once, got %v, %v, and %v uploads", index, size, progress.encrypted[index], progress.uploaded[index], api.uploadedBlocks[strconv.Itoa(index)])
+		}
+	}
+	if len(progress.committed) != 1 || progress.committed["linkID"] != int64(len(content)) {
+		t.Fatalf("expected linkID committed with %v bytes, got %v", len(content), progress.committed)
+	}
+}
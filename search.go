@@ -69,22 +69,29 @@ func (protonDrive *ProtonDrive) SearchByNameInActiveFolder(
 		return nil, err
 	}
 
-	targetNameHash, err := proton.GetNameHash(targetName, folderHashKey)
-	if err != nil {
-		return nil, err
+	// the name as given comes first, then its normalized form, which is what we upload with, see ValidateName
+	targetNameHashes := make([]string, 0, 2)
+	for _, name := range []string{targetName, NormalizeName(targetName)} {
+		targetNameHash, err := proton.GetNameHash(name, folderHashKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(targetNameHashes) == 0 || targetNameHashes[0] != targetNameHash {
+			targetNameHashes = append(targetNameHashes, targetNameHash)
+		}
 	}
 
 	// use available hash to check if it exists
 	// more efficient than linear scan to just do existence check
 	// used in rclone when Put(), it will try to see if the object exists or not
 	res, err := protonDrive.c.CheckAvailableHashes(ctx, protonDrive.MainShare.ShareID, folderLink.LinkID, proton.CheckAvailableHashesReq{
-		Hashes: []string{targetNameHash},
+		Hashes: targetNameHashes,
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	if len(res.AvailableHashes) == 1 {
+	if len(res.AvailableHashes) == len(targetNameHashes) {
 		// name isn't taken == name doesn't exist
 		return nil, nil
 	}
@@ -93,15 +100,17 @@ func (protonDrive *ProtonDrive) SearchByNameInActiveFolder(
 	if err != nil {
 		return nil, err
 	}
-	for _, childLink := range childrenLinks {
-		if childLink.State != targetState {
-			continue
-		}
-
-		if searchForFile && childLink.Type == proton.LinkTypeFile && childLink.Hash == targetNameHash {
-			return &childLink, nil
-		} else if searchForFolder && childLink.Type == proton.LinkTypeFolder && childLink.Hash == targetNameHash {
-			return &childLink, nil
+	for _, targetNameHash := range targetNameHashes {
+		for _, childLink := range childrenLinks {
+			if childLink.State != targetState {
+				continue
+			}
+
+			if searchForFile && childLink.Type == proton.LinkTypeFile && childLink.Hash == targetNameHash {
+				return &childLink, nil
+			} else if searchForFolder && childLink.Type == proton.LinkTypeFolder && childLink.Hash == targetNameHash {
+				return &childLink, nil
+			}
 		}
 	}
 